@@ -3,43 +3,88 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"pdserver/pkg/api"
 	"pdserver/pkg/app"
+	"pdserver/pkg/config"
+	"pdserver/pkg/mailer"
 	"pdserver/pkg/repository"
 )
 
-type Application struct{}
+type Application struct {
+	Config *config.Config
+}
 
-func NewApp() *Application {
-	return &Application{}
+func NewApp(cfg *config.Config) *Application {
+	return &Application{Config: cfg}
 }
 
 func (application *Application) Run() error {
 	fmt.Println("App running start...")
-	localDB, err := repository.NewDatabase()
+	cfg := application.Config
+	localDB, err := repository.NewDatabase(cfg.Database)
 	if err != nil {
 		return err
 	}
 	defer localDB.Close()
-	redisDB, err := repository.NewClient()
+	migrator, err := repository.NewMigrator(localDB)
+	if err != nil {
+		return err
+	}
+	if err := migrator.Check(); err != nil {
+		return err
+	}
+	redisDB, err := repository.NewClient(cfg.Redis)
 	if err != nil {
 		return err
 	}
 	defer redisDB.Close()
-	userService := api.NewUserDB(localDB)
-	tokenService := api.NewTokenDB(redisDB)
-	naverService := api.NewNaverService()
-	otpService := api.NewOTPService()
-	handler := app.NewHandler(userService, tokenService, naverService, otpService)
+	userService := api.NewUserDB(localDB, api.NewPasswordHasher(cfg.Password))
+	go api.NewAccountPurger(userService, cfg.Account).Run(nil)
+	redisStore := repository.NewRedisStore(redisDB)
+	keyRing := api.NewKeyRing(redisStore, cfg.JWT)
+	if err := keyRing.Rotate(); err != nil {
+		return err
+	}
+	go keyRing.Run(nil)
+	tokenService := api.NewTokenDB(redisStore, keyRing, cfg.JWT, api.NewLogAuditor(), userService)
+	oauthService := api.NewOAuthRegistry(cfg.OAuth, cfg.Server.PublicURL, redisStore)
+	handoffService := api.NewAppHandoff(redisStore, cfg.App)
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		return err
+	}
+	mailQueue := api.NewMailQueue(redisStore, mail, cfg.MailQueue)
+	mailQueue.ExpireAfter(cfg.OTP.CodeTTL, mailer.TemplateSignupCode, mailer.TemplatePasswordReset, mailer.TemplateAccountUnlock)
+	go mailQueue.Run(nil)
+	otpService := api.NewOTPService(redisStore, mailQueue, cfg.OTP)
+	handler := app.NewHandler(userService, tokenService, oauthService, otpService, handoffService, mailQueue,
+		api.NewRateLimiter(redisStore, cfg.RateLimit), api.NewLoginGuard(redisStore, cfg.Lockout),
+		api.NewTwoFactor(userService, redisStore, cfg.TwoFactor, cfg.JWT.KeyEncryptionKey))
+	if err := handler.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return err
+	}
 	handler.SetupRoutes()
-	if err := http.ListenAndServe(":8080", handler.Engin); err != nil {
+	if err := http.ListenAndServe(cfg.Server.Addr, handler.Engin); err != nil {
 		return err
 	}
 	return nil
 }
 
 func main() {
-	application := NewApp()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	application := NewApp(cfg)
 	if err := application.Run(); err != nil {
 		fmt.Println(err.Error())
 		return
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"strings"
+)
+
+const migrateUsage = "usage: migrate <up|down [steps]|status> [flags]"
+
+// runMigrate - migrate subcommand, flags after the action are the usual server flags
+func runMigrate(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf(migrateUsage)
+	}
+	action, args := args[0], args[1:]
+	if action != "up" && action != "down" && action != "status" {
+		return fmt.Errorf(migrateUsage)
+	}
+	steps := 1
+	if action == "down" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid steps %s", args[0])
+		}
+		steps, args = n, args[1:]
+	}
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	db, err := repository.NewDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator, err := repository.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		applied, err := migrator.Up()
+		for _, migration := range applied {
+			fmt.Printf("applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("schema is at version %d\n", migrator.Latest())
+	case "down":
+		reverted, err := migrator.Down(steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", status.Version, status.Name, appliedAt)
+		}
+	}
+	return nil
+}
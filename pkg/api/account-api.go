@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"time"
+)
+
+var (
+	ErrAccountDeleted    = errors.New("Account is scheduled for deletion")
+	ErrAccountNotDeleted = errors.New("Account is not scheduled for deletion")
+)
+
+// Restore - Undo Delete while the user is still in its grace period
+func (db *UserDB) Restore(id uint64) error {
+	res := db.Storage.Unscoped().Model(&model.User{}).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrAccountNotDeleted
+	}
+	return nil
+}
+
+// Purge - Permanently remove users deleted before the time along with their identities, second factors and roles
+func (db *UserDB) Purge(before time.Time) ([]uint64, error) {
+	ids := []uint64{}
+	tx := db.Storage.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if res := tx.Unscoped().Model(&model.User{}).Where("deleted_at < ?", before).Pluck("id", &ids); res.Error != nil {
+		tx.Rollback()
+		return nil, res.Error
+	}
+	if len(ids) == 0 {
+		tx.Rollback()
+		return ids, nil
+	}
+	for _, owned := range []interface{}{&model.Identity{}, &model.TOTPCredential{}, &model.RecoveryCode{}, &model.UserRole{}} {
+		if res := tx.Where("user_id IN (?)", ids).Delete(owned); res.Error != nil {
+			tx.Rollback()
+			return nil, res.Error
+		}
+	}
+	if res := tx.Unscoped().Where("id IN (?)", ids).Delete(&model.User{}); res.Error != nil {
+		tx.Rollback()
+		return nil, res.Error
+	}
+	if res := tx.Commit(); res.Error != nil {
+		return nil, res.Error
+	}
+	return ids, nil
+}
+
+// AccountPurger - Scheduled hard delete of accounts past their grace period
+type AccountPurger struct {
+	Users  UserAPIService
+	Config config.AccountConfig
+}
+
+func NewAccountPurger(users UserAPIService, cfg config.AccountConfig) *AccountPurger {
+	return &AccountPurger{Users: users, Config: cfg}
+}
+
+// Run - Purge every PurgeInterval until stop is closed
+func (p *AccountPurger) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.Config.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := p.Purge(); err != nil {
+				log.Println(err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Purge - Remove accounts deleted longer than the grace period ago
+func (p *AccountPurger) Purge() ([]uint64, error) {
+	ids, err := p.Users.Purge(time.Now().Add(-p.Config.DeletionGrace))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		log.Printf("purged %d deleted accounts", len(ids))
+	}
+	return ids, nil
+}
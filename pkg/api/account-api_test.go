@@ -0,0 +1,36 @@
+package api
+
+import (
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestPurgeRemovesRoles(t *testing.T) {
+	db := NewMemoryUserDB(NewPasswordHasher(config.PasswordConfig{Cost: 4}))
+	user := &model.User{Email: "mod@example.com", Nickname: "moderator", Password: "password123"}
+	if err := db.Post(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRoles(user.ID, []string{model.RoleModerator}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := db.Purge(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != user.ID {
+		t.Fatalf("purged %v", ids)
+	}
+	roles, err := db.GetRoles(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Fatalf("roles left after purge: %v", roles)
+	}
+}
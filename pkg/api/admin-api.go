@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/api/model"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrAccountSuspended = errors.New("Account is suspended")
+	ErrUnknownRole      = errors.New("Unknown role")
+)
+
+// likeEscaper - Search text is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ListUsers - Page of users whose email, name or nickname contains query, all users when it is empty
+func (db *UserDB) ListUsers(query string, offset int, limit int) ([]model.User, int, error) {
+	users := []model.User{}
+	total := 0
+	scope := db.Storage.Model(&model.User{})
+	if query != "" {
+		like := "%" + likeEscaper.Replace(query) + "%"
+		scope = scope.Where("email LIKE ? OR name LIKE ? OR nickname LIKE ?", like, like, like)
+	}
+	if res := scope.Count(&total); res.Error != nil {
+		return nil, 0, res.Error
+	}
+	if res := scope.Order("id").Offset(offset).Limit(limit).Find(&users); res.Error != nil {
+		return nil, 0, res.Error
+	}
+	return users, total, nil
+}
+
+func (db *UserDB) GetRoles(userID uint64) ([]string, error) {
+	roles := []string{}
+	if res := db.Storage.Model(&model.UserRole{}).Where("user_id = ?", userID).Order("role").Pluck("role", &roles); res.Error != nil {
+		return nil, res.Error
+	}
+	return roles, nil
+}
+
+// SetRoles - Replace the roles of the user
+func (db *UserDB) SetRoles(userID uint64, roles []string) error {
+	for _, role := range roles {
+		if !model.ValidRole(role) {
+			return ErrUnknownRole
+		}
+	}
+	if _, err := db.GetWithID(userID); err != nil {
+		return err
+	}
+	return db.Storage.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", userID).Delete(&model.UserRole{}); res.Error != nil {
+			return res.Error
+		}
+		for _, role := range roles {
+			if res := tx.Create(&model.UserRole{UserID: userID, Role: role}); res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+}
+
+// Suspend - Block the user from signing in, the caller revokes its sessions
+func (db *UserDB) Suspend(userID uint64) error {
+	return db.setSuspended(userID, time.Now())
+}
+
+func (db *UserDB) Unsuspend(userID uint64) error {
+	return db.setSuspended(userID, nil)
+}
+
+func (db *UserDB) setSuspended(userID uint64, val interface{}) error {
+	res := db.Storage.Model(&model.User{}).Where("id = ?", userID).Update("suspended_at", val)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := db.GetWithID(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
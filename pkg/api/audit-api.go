@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	AuditRefreshTokenReuse = "refresh_token_reuse"
+)
+
+// AuditEvent - Security relevant event, kept apart from the request log
+type AuditEvent struct {
+	Type   string            `json:"type"`
+	UserID uint64            `json:"user_id"`
+	Detail map[string]string `json:"detail,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+type Auditor interface {
+	Emit(event AuditEvent)
+}
+
+// LogAuditor - Write audit events as JSON lines to the standard logger
+type LogAuditor struct{}
+
+func NewLogAuditor() *LogAuditor {
+	return &LogAuditor{}
+}
+
+func (a *LogAuditor) Emit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	log.Printf("audit %s", data)
+}
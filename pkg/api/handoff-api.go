@@ -0,0 +1,103 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+)
+
+var (
+	ErrInvalidRedirectURI = errors.New("Redirect uri is not allowed")
+	ErrInvalidAuthCode    = errors.New("Invalid or expired authorization code")
+)
+
+// HandoffAPIService - Hands a finished OAuth sign in to the native app.
+// The callback sends a short lived code to the app, which exchanges it with its PKCE verifier.
+type HandoffAPIService interface {
+	RedirectURI(requested string) (string, error)
+	CreateCode(userID uint64, challenge string, redirectURI string) (string, error)
+	Exchange(code string, verifier string, redirectURI string) (uint64, error)
+}
+
+type AppHandoff struct {
+	Storage repository.KeyValueStore
+	Config  config.AppConfig
+}
+
+type authCode struct {
+	UserID        uint64 `json:"user_id"`
+	CodeChallenge string `json:"code_challenge"`
+	RedirectURI   string `json:"redirect_uri"`
+}
+
+func NewAppHandoff(store repository.KeyValueStore, cfg config.AppConfig) *AppHandoff {
+	return &AppHandoff{Storage: store, Config: cfg}
+}
+
+// RedirectURI - Allowed app uri for requested, the first configured one when requested is empty
+func (a *AppHandoff) RedirectURI(requested string) (string, error) {
+	if requested == "" {
+		return a.Config.RedirectURIs[0], nil
+	}
+	for _, uri := range a.Config.RedirectURIs {
+		if uri == requested {
+			return uri, nil
+		}
+	}
+	return "", ErrInvalidRedirectURI
+}
+
+// CreateCode - Single use code bound to the app's S256 challenge
+func (a *AppHandoff) CreateCode(userID uint64, challenge string, redirectURI string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(authCode{UserID: userID, CodeChallenge: challenge, RedirectURI: redirectURI})
+	if err != nil {
+		return "", err
+	}
+	if err := a.Storage.Set(authCodeKey(code), string(data), a.Config.CodeTTL); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Exchange - User the code was issued for. The code is burned on the first attempt,
+// so a wrong verifier cannot be retried.
+func (a *AppHandoff) Exchange(code string, verifier string, redirectURI string) (uint64, error) {
+	if code == "" || verifier == "" {
+		return 0, ErrInvalidAuthCode
+	}
+	data, err := a.Storage.Get(authCodeKey(code))
+	if errors.Is(err, repository.ErrNil) {
+		return 0, ErrInvalidAuthCode
+	}
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := a.Storage.Del(authCodeKey(code))
+	if err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, ErrInvalidAuthCode
+	}
+	var stored authCode
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(codeChallenge(verifier)), []byte(stored.CodeChallenge)) != 1 {
+		return 0, ErrInvalidAuthCode
+	}
+	if redirectURI != "" && redirectURI != stored.RedirectURI {
+		return 0, ErrInvalidAuthCode
+	}
+	return stored.UserID, nil
+}
+
+func authCodeKey(code string) string {
+	return "oauth:code:" + code
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/api/model"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrIdentityInUse      = errors.New("This account is already linked to another user")
+	ErrProviderLinked     = errors.New("Another account of this provider is already linked")
+	ErrIdentityNotFound   = errors.New("Provider is not linked")
+	ErrLastLoginMethod    = errors.New("Cannot unlink the only way to sign in")
+	ErrAccountEmailExists = errors.New("An account with this email already exists")
+)
+
+// GetByIdentity - Find the user an external account is linked to.
+// A deleted user is returned together with ErrAccountDeleted so it can be restored,
+// a suspended one with ErrAccountSuspended.
+func (db *UserDB) GetByIdentity(provider string, providerUserID string) (*model.User, error) {
+	var identity model.Identity
+	if res := db.Storage.Where(&model.Identity{Provider: provider, ProviderUserID: providerUserID}).First(&identity); res.Error != nil {
+		return nil, res.Error
+	}
+	var user model.User
+	if res := db.Storage.Unscoped().First(&user, identity.UserID); res.Error != nil {
+		return nil, res.Error
+	}
+	if user.DeletedAt != nil {
+		return &user, ErrAccountDeleted
+	}
+	if user.SuspendedAt != nil {
+		return &user, ErrAccountSuspended
+	}
+	return &user, nil
+}
+
+// LinkIdentity - Link external account to identity.UserID
+func (db *UserDB) LinkIdentity(identity *model.Identity) error {
+	var existing model.Identity
+	res := db.Storage.Where(&model.Identity{Provider: identity.Provider, ProviderUserID: identity.ProviderUserID}).First(&existing)
+	if res.Error == nil {
+		if existing.UserID == identity.UserID {
+			return nil
+		}
+		return ErrIdentityInUse
+	}
+	if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return res.Error
+	}
+	res = db.Storage.Where(&model.Identity{UserID: identity.UserID, Provider: identity.Provider}).First(&existing)
+	if res.Error == nil {
+		return ErrProviderLinked
+	}
+	if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return res.Error
+	}
+	if res := db.Storage.Create(identity); res.Error != nil {
+		return res.Error
+	}
+	return nil
+}
+
+// UnlinkIdentity - Remove provider from user, keeping at least one way to sign in
+func (db *UserDB) UnlinkIdentity(userID uint64, provider string) error {
+	identities, err := db.ListIdentities(userID)
+	if err != nil {
+		return err
+	}
+	target, err := findIdentity(identities, provider)
+	if err != nil {
+		return err
+	}
+	user, err := db.GetWithID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Password == "" && len(identities) == 1 {
+		return ErrLastLoginMethod
+	}
+	if res := db.Storage.Delete(&model.Identity{}, target.ID); res.Error != nil {
+		return res.Error
+	}
+	return nil
+}
+
+func (db *UserDB) ListIdentities(userID uint64) ([]model.Identity, error) {
+	identities := []model.Identity{}
+	if res := db.Storage.Where(&model.Identity{UserID: userID}).Order("created_at").Find(&identities); res.Error != nil {
+		return nil, res.Error
+	}
+	return identities, nil
+}
+
+func findIdentity(identities []model.Identity, provider string) (*model.Identity, error) {
+	for i := range identities {
+		if identities[i].Provider == provider {
+			return &identities[i], nil
+		}
+	}
+	return nil, ErrIdentityNotFound
+}
@@ -0,0 +1,346 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	keyRingIndexKey = "jwt:keys"
+	keyBits         = 2048
+	// Only one server generates the next key, the others pick it up from redis
+	keyRingLockKey = "jwt:rotate"
+	keyRingLockTTL = 30 * time.Second
+)
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// KeyRing - RSA keys used to sign tokens, shared by all servers through redis.
+// A new key is published ahead of use, becomes the signing key at its NotBefore,
+// and stays available for verification until tokens signed with it have expired.
+// Private keys are encrypted with Config.KeyEncryptionKey before they are stored.
+type KeyRing struct {
+	Storage repository.KeyValueStore
+	Config  config.JWTConfig
+
+	mu   sync.RWMutex
+	keys map[string]*signingKey
+}
+
+type signingKey struct {
+	ID         string
+	PrivateKey *rsa.PrivateKey
+	NotBefore  time.Time
+	ExpiresAt  time.Time
+}
+
+// storedKey - Key as kept in redis, Sealed is the AES-GCM encrypted PKCS1 key with the kid as additional data
+type storedKey struct {
+	ID        string    `json:"kid"`
+	Sealed    []byte    `json:"sealed"`
+	NotBefore time.Time `json:"not_before"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewKeyRing(store repository.KeyValueStore, cfg config.JWTConfig) *KeyRing {
+	return &KeyRing{Storage: store, Config: cfg, keys: map[string]*signingKey{}}
+}
+
+// Run - Rotate keys on schedule until stop is closed
+func (k *KeyRing) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(k.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.Rotate(); err != nil {
+				log.Println(err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Rotate - Reload keys and publish the next key when the current one is due
+func (k *KeyRing) Rotate() error {
+	if err := k.load(); err != nil {
+		return err
+	}
+	if _, due := k.next(time.Now()); !due {
+		return nil
+	}
+	// The lock may expire while a slow server still holds it, only its owner releases it
+	owner := uuid.NewString()
+	locked, err := k.Storage.SetNX(keyRingLockKey, owner, keyRingLockTTL)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return k.waitForKey()
+	}
+	defer k.Storage.DelIfEqual(keyRingLockKey, owner)
+	// Another server may have published the key before the lock was taken
+	if err := k.load(); err != nil {
+		return err
+	}
+	notBefore, due := k.next(time.Now())
+	if !due {
+		return nil
+	}
+	return k.generate(notBefore)
+}
+
+// next - NotBefore of the next key and whether it has to be published now
+func (k *KeyRing) next(now time.Time) (time.Time, bool) {
+	newest := k.newest()
+	if newest == nil {
+		return now, true
+	}
+	due := newest.NotBefore.Add(k.Config.KeyRotation)
+	if now.Before(due.Add(-k.Config.KeyPrepublish)) {
+		return time.Time{}, false
+	}
+	if due.Before(now) {
+		due = now
+	}
+	return due, true
+}
+
+// waitForKey - Wait for the server holding the rotation lock when there is nothing to sign with yet
+func (k *KeyRing) waitForKey() error {
+	deadline := time.Now().Add(keyRingLockTTL)
+	for {
+		if _, _, err := k.Signer(); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("No signing key published by the server rotating keys")
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := k.load(); err != nil {
+			return err
+		}
+	}
+}
+
+// Signer - Key tokens are signed with right now
+func (k *KeyRing) Signer() (string, *rsa.PrivateKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	var current *signingKey
+	for _, key := range k.keys {
+		if key.NotBefore.After(now) || now.After(key.ExpiresAt) {
+			continue
+		}
+		if current == nil || key.NotBefore.After(current.NotBefore) {
+			current = key
+		}
+	}
+	if current == nil {
+		return "", nil, fmt.Errorf("No signing key available")
+	}
+	return current.ID, current.PrivateKey, nil
+}
+
+// PublicKey - Verification key for kid, reloading from redis for keys made by other servers
+func (k *KeyRing) PublicKey(kid string) (*rsa.PublicKey, error) {
+	if key := k.lookup(kid); key != nil {
+		return &key.PrivateKey.PublicKey, nil
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if key := k.lookup(kid); key != nil {
+		return &key.PrivateKey.PublicKey, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWKS - Public keys of every key that may have signed a live token or will sign one soon
+func (k *KeyRing) JWKS() model.JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	jwks := model.JWKS{Keys: []model.JWK{}}
+	for _, key := range k.keys {
+		if now.After(key.ExpiresAt) {
+			continue
+		}
+		pub := key.PrivateKey.PublicKey
+		jwks.Keys = append(jwks.Keys, model.JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: key.ID,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return jwks
+}
+
+func (k *KeyRing) generate(notBefore time.Time) error {
+	privateKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return err
+	}
+	key := &signingKey{
+		ID:         uuid.NewString(),
+		PrivateKey: privateKey,
+		NotBefore:  notBefore,
+		// Signs for at most one rotation period, then verifies until its last token expires
+		ExpiresAt: notBefore.Add(k.Config.KeyRotation + k.Config.RefreshTTL),
+	}
+	if err := k.put(key); err != nil {
+		return err
+	}
+	if err := k.Storage.SAdd(keyRingIndexKey, key.ID); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys[key.ID] = key
+	k.mu.Unlock()
+	return nil
+}
+
+// load - Replace cached keys with the ones in redis
+func (k *KeyRing) load() error {
+	ids, err := k.Storage.SMembers(keyRingIndexKey)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*signingKey{}
+	for _, id := range ids {
+		data, err := k.Storage.Get(keyRingKey(id))
+		if errors.Is(err, repository.ErrNil) {
+			if err := k.Storage.SRem(keyRingIndexKey, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		key, err := k.parseStoredKey(data)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *KeyRing) lookup(kid string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok || time.Now().After(key.ExpiresAt) {
+		return nil
+	}
+	return key
+}
+
+func (k *KeyRing) newest() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var newest *signingKey
+	for _, key := range k.keys {
+		if newest == nil || key.NotBefore.After(newest.NotBefore) {
+			newest = key
+		}
+	}
+	return newest
+}
+
+func (k *KeyRing) checkInterval() time.Duration {
+	interval := k.Config.KeyPrepublish / 4
+	if interval <= 0 || interval > time.Hour {
+		interval = time.Hour
+	}
+	return interval
+}
+
+// put - Store key encrypted until it expires
+func (k *KeyRing) put(key *signingKey) error {
+	aead, err := k.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, x509.MarshalPKCS1PrivateKey(key.PrivateKey), []byte(key.ID))
+	data, err := json.Marshal(storedKey{ID: key.ID, Sealed: sealed, NotBefore: key.NotBefore, ExpiresAt: key.ExpiresAt})
+	if err != nil {
+		return err
+	}
+	return k.Storage.Set(keyRingKey(key.ID), string(data), time.Until(key.ExpiresAt))
+}
+
+// parseStoredKey - Decrypt a stored key
+func (k *KeyRing) parseStoredKey(data string) (*signingKey, error) {
+	var stored storedKey
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.Sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid private key of %s", stored.ID)
+	}
+	nonce, ciphertext := stored.Sealed[:aead.NonceSize()], stored.Sealed[aead.NonceSize():]
+	der, err := aead.Open(nil, nonce, ciphertext, []byte(stored.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt private key of %s, check the key encryption key", stored.ID)
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{ID: stored.ID, PrivateKey: privateKey, NotBefore: stored.NotBefore, ExpiresAt: stored.ExpiresAt}, nil
+}
+
+func (k *KeyRing) aead() (cipher.AEAD, error) {
+	return newAEAD(k.Config.KeyEncryptionKey)
+}
+
+// newAEAD - AES-GCM with the base64 key encryption key, secrets are stored as nonce and ciphertext
+func newAEAD(keyEncryptionKey string) (cipher.AEAD, error) {
+	kek, err := base64.StdEncoding.DecodeString(keyEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key encryption key: %s", err.Error())
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key encryption key: %s", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+func keyRingKey(kid string) string {
+	return "jwt:key:" + kid
+}
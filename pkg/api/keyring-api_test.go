@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJWTConfig() config.JWTConfig {
+	return config.JWTConfig{AccessTTL: time.Hour, RefreshTTL: 24 * time.Hour, KeyRotation: 30 * 24 * time.Hour,
+		KeyPrepublish: 24 * time.Hour, KeyEncryptionKey: base64.StdEncoding.EncodeToString(make([]byte, 32))}
+}
+
+func TestKeyRingStoresKeysEncrypted(t *testing.T) {
+	store := repository.NewMemoryStore()
+	ring := NewKeyRing(store, testJWTConfig())
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	kid, _, err := ring.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(keyRingKey(kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "PRIVATE KEY") || !strings.Contains(data, "sealed") {
+		t.Fatalf("stored key is not encrypted: %s", data)
+	}
+
+	// Another server with the same key encryption key verifies the tokens
+	if _, err := NewKeyRing(store, testJWTConfig()).PublicKey(kid); err != nil {
+		t.Fatal(err)
+	}
+	wrong := testJWTConfig()
+	wrong.KeyEncryptionKey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 32)))
+	if _, err := NewKeyRing(store, wrong).PublicKey(kid); err == nil {
+		t.Fatal("key decrypted with the wrong key encryption key")
+	}
+}
+
+func TestKeyRingRotatesOnce(t *testing.T) {
+	store := repository.NewMemoryStore()
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- NewKeyRing(store, testJWTConfig()).Rotate()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := store.SMembers(keyRingIndexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("%d keys published by concurrent servers", len(ids))
+	}
+	if _, err := store.Get(keyRingLockKey); !errors.Is(err, repository.ErrNil) {
+		t.Fatalf("rotation lock left behind: %v", err)
+	}
+	// A server whose lock expired does not release the lock of the next one
+	store.Set(keyRingLockKey, "next", time.Minute)
+	if released, _ := store.DelIfEqual(keyRingLockKey, "expired"); released {
+		t.Fatal("lock released by a server not holding it")
+	}
+}
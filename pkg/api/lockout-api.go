@@ -0,0 +1,244 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrLoginDelayed  = errors.New("Too many failed sign ins, wait before trying again")
+	ErrAccountLocked = errors.New("Account is temporarily locked")
+	ErrIPLocked      = errors.New("Too many failed sign ins from this address")
+)
+
+// LoginBlockedError - Sign in refused until RetryAfter has passed, wraps one of the errors above
+type LoginBlockedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return e.Err
+}
+
+// LoginGuard - Counts failed sign ins per account and per IP and blocks further attempts,
+// see config.LockoutConfig. Accounts are keyed by email so unknown addresses behave the same.
+// An attempt is counted as failed before the password is checked and given back when it was right,
+// so concurrent attempts cannot all pass the checks before any failure is recorded.
+type LoginGuard struct {
+	Storage repository.KeyValueStore
+	Config  config.LockoutConfig
+}
+
+// LoginAttempt - Sign in reserved by Reserve, Failures and IPFailures include it
+type LoginAttempt struct {
+	Email      string
+	IP         string
+	Failures   int64
+	IPFailures int64
+	guarded    bool
+}
+
+type LockoutAPIService interface {
+	Reserve(email string, ip string) (*LoginAttempt, error)
+	Fail(attempt *LoginAttempt) (time.Duration, error)
+	Release(attempt *LoginAttempt) error
+	Reset(email string) error
+}
+
+const (
+	// An attempt holds the account this long at most, far longer than checking a password takes
+	lockoutGuardTTL = 10 * time.Second
+	// Attempts refused for another one in flight can try again this soon
+	lockoutBusyRetry = time.Second
+)
+
+func NewLoginGuard(store repository.KeyValueStore, cfg config.LockoutConfig) *LoginGuard {
+	return &LoginGuard{Storage: store, Config: cfg}
+}
+
+// Reserve - Count a sign in attempt as failed, LoginBlockedError when the IP or account may not try now.
+// Past DelayAfter failures only one attempt per account is let through at a time.
+// The attempt has to end with Fail, or with Release when the password was not wrong.
+func (g *LoginGuard) Reserve(email string, ip string) (*LoginAttempt, error) {
+	email = normalizeEmail(email)
+	if err := g.check(email, ip); err != nil {
+		return nil, err
+	}
+	attempt := &LoginAttempt{Email: email, IP: ip}
+	var err error
+	if attempt.IPFailures, err = g.count(lockoutIPFailuresKey(ip)); err != nil {
+		return nil, err
+	}
+	if attempt.Failures, err = g.count(lockoutFailuresKey(email)); err != nil {
+		return nil, err
+	}
+	busy := attempt.IPFailures > int64(g.Config.IPLockAfter)
+	if !busy && attempt.Failures > int64(g.Config.DelayAfter) {
+		attempt.guarded, err = g.Storage.SetNX(lockoutGuardKey(email), "1", lockoutGuardTTL)
+		if err != nil {
+			return nil, err
+		}
+		busy = !attempt.guarded
+	}
+	if busy {
+		// Attempts in flight may still lock the account or IP
+		if err := g.Release(attempt); err != nil {
+			return nil, err
+		}
+		return nil, &LoginBlockedError{Err: ErrLoginDelayed, RetryAfter: lockoutBusyRetry}
+	}
+	return attempt, nil
+}
+
+// check - LoginBlockedError when the IP or account is locked or has to wait
+func (g *LoginGuard) check(email string, ip string) error {
+	for _, block := range []struct {
+		key string
+		err error
+	}{
+		{lockoutIPLockKey(ip), ErrIPLocked},
+		{lockoutLockKey(email), ErrAccountLocked},
+		{lockoutNextKey(email), ErrLoginDelayed},
+	} {
+		until, err := g.until(block.key)
+		if err != nil {
+			return err
+		}
+		if wait := time.Until(until); wait > 0 {
+			return &LoginBlockedError{Err: block.err, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// Fail - The reserved attempt had a wrong password, how long the account is locked when this failure locked it
+func (g *LoginGuard) Fail(attempt *LoginAttempt) (time.Duration, error) {
+	if attempt.guarded {
+		defer g.Storage.Del(lockoutGuardKey(attempt.Email))
+	}
+	if attempt.IPFailures == int64(g.Config.IPLockAfter) {
+		if err := g.block(lockoutIPLockKey(attempt.IP), g.Config.LockDuration); err != nil {
+			return 0, err
+		}
+		if _, err := g.Storage.Del(lockoutIPFailuresKey(attempt.IP)); err != nil {
+			return 0, err
+		}
+	}
+	switch {
+	case attempt.Failures >= int64(g.Config.LockAfter):
+		// The lock starts a new count once it ends
+		if _, err := g.Storage.Del(lockoutFailuresKey(attempt.Email), lockoutNextKey(attempt.Email)); err != nil {
+			return 0, err
+		}
+		return g.Config.LockDuration, g.block(lockoutLockKey(attempt.Email), g.Config.LockDuration)
+	case attempt.Failures >= int64(g.Config.DelayAfter):
+		return 0, g.block(lockoutNextKey(attempt.Email), g.delay(int(attempt.Failures)))
+	}
+	return 0, nil
+}
+
+// Release - Give back the reserved attempt, its password was right or could not be checked
+func (g *LoginGuard) Release(attempt *LoginAttempt) error {
+	if attempt.guarded {
+		defer g.Storage.Del(lockoutGuardKey(attempt.Email))
+	}
+	for _, key := range []string{lockoutIPFailuresKey(attempt.IP), lockoutFailuresKey(attempt.Email)} {
+		n, err := g.Storage.Decr(key)
+		if err != nil {
+			return err
+		}
+		// The counter expired in between, decrementing created it without a ttl
+		if n <= 0 {
+			if _, err := g.Storage.Del(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reset - Forget failures and lift the lock of the account, after a sign in or proof of owning the email
+func (g *LoginGuard) Reset(email string) error {
+	email = normalizeEmail(email)
+	_, err := g.Storage.Del(lockoutFailuresKey(email), lockoutNextKey(email), lockoutLockKey(email))
+	return err
+}
+
+// delay - Wait after failures, Delay doubled for every failure past DelayAfter up to LockDuration
+func (g *LoginGuard) delay(failures int) time.Duration {
+	wait := g.Config.Delay
+	for i := g.Config.DelayAfter; i < failures && wait < g.Config.LockDuration; i++ {
+		wait *= 2
+	}
+	if wait > g.Config.LockDuration {
+		wait = g.Config.LockDuration
+	}
+	return wait
+}
+
+// count - Increment a failure counter that lives for Config.Window from the first failure
+func (g *LoginGuard) count(key string) (int64, error) {
+	n, err := g.Storage.Incr(key)
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err := g.Storage.Expire(key, g.Config.Window); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// block - Keep the end of the block as value, the store cannot tell the remaining ttl
+func (g *LoginGuard) block(key string, ttl time.Duration) error {
+	until := time.Now().Add(ttl)
+	return g.Storage.Set(key, strconv.FormatInt(until.UnixNano(), 10), ttl)
+}
+
+func (g *LoginGuard) until(key string) (time.Time, error) {
+	val, err := g.Storage.Get(key)
+	if errors.Is(err, repository.ErrNil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func lockoutFailuresKey(email string) string {
+	return "lockout:failures:" + email
+}
+
+func lockoutNextKey(email string) string {
+	return "lockout:next:" + email
+}
+
+func lockoutLockKey(email string) string {
+	return "lockout:lock:" + email
+}
+
+func lockoutIPFailuresKey(ip string) string {
+	return "lockout:ip_failures:" + ip
+}
+
+func lockoutIPLockKey(ip string) string {
+	return "lockout:ip_lock:" + ip
+}
+
+func lockoutGuardKey(email string) string {
+	return "lockout:guard:" + email
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLoginGuard() *LoginGuard {
+	return NewLoginGuard(repository.NewMemoryStore(), config.LockoutConfig{Window: time.Hour, DelayAfter: 2,
+		Delay: time.Millisecond, LockAfter: 4, LockDuration: time.Hour, IPLockAfter: 6})
+}
+
+// failLogin - One attempt with a wrong password, waiting out the delay of the previous one first
+func failLogin(t *testing.T, guard *LoginGuard, email string, ip string) time.Duration {
+	t.Helper()
+	time.Sleep(10 * time.Millisecond)
+	attempt, err := guard.Reserve(email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := guard.Fail(attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return locked
+}
+
+func expectBlocked(t *testing.T, guard *LoginGuard, email string, ip string, want error) {
+	t.Helper()
+	_, err := guard.Reserve(email, ip)
+	var blocked *LoginBlockedError
+	if !errors.As(err, &blocked) || !errors.Is(err, want) || blocked.RetryAfter <= 0 {
+		t.Fatalf("reserve: %v, want %v", err, want)
+	}
+}
+
+func TestLockoutThresholds(t *testing.T) {
+	guard := newTestLoginGuard()
+	failLogin(t, guard, "user@example.com", "192.0.2.1")
+	if _, err := guard.Reserve("user@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("no delay before DelayAfter: %v", err)
+	}
+	guard = newTestLoginGuard()
+	failLogin(t, guard, "user@example.com", "192.0.2.1")
+	failLogin(t, guard, "user@example.com", "192.0.2.1")
+	expectBlocked(t, guard, "user@example.com", "192.0.2.1", ErrLoginDelayed)
+	failLogin(t, guard, "user@example.com", "192.0.2.1")
+	if locked := failLogin(t, guard, "user@example.com", "192.0.2.1"); locked != time.Hour {
+		t.Fatalf("locked for %s at LockAfter", locked)
+	}
+	expectBlocked(t, guard, "user@example.com", "192.0.2.1", ErrAccountLocked)
+	// Other accounts from the IP are not locked, the IP is at IPLockAfter
+	failLogin(t, guard, "other@example.com", "192.0.2.1")
+	failLogin(t, guard, "other@example.com", "192.0.2.1")
+	expectBlocked(t, guard, "third@example.com", "192.0.2.1", ErrIPLocked)
+
+	if err := guard.Reset("user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guard.Reserve("user@example.com", "192.0.2.2"); err != nil {
+		t.Fatalf("after reset: %v", err)
+	}
+}
+
+func TestLockoutReleaseGivesBackAttempt(t *testing.T) {
+	guard := newTestLoginGuard()
+	for i := 0; i < 10; i++ {
+		attempt, err := guard.Reserve("user@example.com", "192.0.2.1")
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		if attempt.Failures != 1 || attempt.IPFailures != 1 {
+			t.Fatalf("attempt %d counted as %+v", i+1, attempt)
+		}
+		if err := guard.Release(attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentAttemptsCannotPassLock(t *testing.T) {
+	guard := newTestLoginGuard()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	attempts := []*LoginAttempt{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			attempt, err := guard.Reserve("user@example.com", "192.0.2."+strconv.Itoa(i))
+			if err == nil {
+				mu.Lock()
+				attempts = append(attempts, attempt)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	// Up to DelayAfter attempts run side by side, past it one at a time
+	if len(attempts) > 3 {
+		t.Fatalf("%d concurrent attempts checked a password", len(attempts))
+	}
+	for _, attempt := range attempts {
+		if _, err := guard.Fail(attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := len(attempts); i < 4; i++ {
+		failLogin(t, guard, "user@example.com", "192.0.2.100")
+	}
+	expectBlocked(t, guard, "user@example.com", "192.0.2.100", ErrAccountLocked)
+}
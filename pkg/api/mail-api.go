@@ -0,0 +1,7 @@
+package api
+
+// MailSender - Delivers mail rendered from a template of package mailer.
+// locale may be empty, the configured mail locale is used then.
+type MailSender interface {
+	Send(to string, template string, locale string, data map[string]string) error
+}
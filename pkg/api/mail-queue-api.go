@@ -0,0 +1,407 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Due jobs are looked up this often
+	mailPollInterval = time.Second
+	// A claimed job is handed to another worker when its worker has not finished by then,
+	// longer than any SMTP timeout
+	mailLease = 5 * time.Minute
+	// Mail keyed by its content is only deduplicated this long, a request retried by the client
+	// is not mailed twice but the same notice sent again later is
+	mailContentDedupe = 10 * time.Minute
+	mailQueueKey      = "mail:queue"
+	mailDeadKey       = "mail:dead"
+)
+
+var (
+	ErrMailNotFound = errors.New("Mail not found")
+	errMailExpired  = errors.New("Expired before it could be delivered")
+)
+
+// MailQueue - Mail is stored in redis and delivered by a pool of workers, so requests never wait on SMTP.
+// Failed sends are retried with exponential backoff and dead-lettered after MaxAttempts.
+// Mail with the same idempotency key is only queued once.
+type MailQueue struct {
+	Storage repository.KeyValueStore
+	Sender  MailSender
+	Config  config.MailQueueConfig
+	// Templates whose mail is useless after the duration, see ExpireAfter
+	Expiring map[string]time.Duration
+}
+
+type MailQueueAPIService interface {
+	MailSender
+	Enqueue(key string, to string, template string, locale string, data map[string]string) (*model.MailJob, error)
+	Get(id string) (*model.MailJob, error)
+	ListByRecipient(email string) ([]model.MailJob, error)
+	ListDead() ([]model.MailJob, error)
+}
+
+func NewMailQueue(store repository.KeyValueStore, sender MailSender, cfg config.MailQueueConfig) *MailQueue {
+	return &MailQueue{Storage: store, Sender: sender, Config: cfg, Expiring: map[string]time.Duration{}}
+}
+
+// ExpireAfter - Mail of the templates is only delivered within ttl of being queued, meant for codes.
+// Their template data is kept apart from the job with that ttl and deleted once the job is done,
+// so codes don't stay in redis for Config.Retention.
+func (q *MailQueue) ExpireAfter(ttl time.Duration, templates ...string) {
+	for _, template := range templates {
+		q.Expiring[template] = ttl
+	}
+}
+
+// Send - Queue mail keyed by its content, identical mail within mailContentDedupe is not delivered twice
+func (q *MailQueue) Send(to string, template string, locale string, data map[string]string) error {
+	_, err := q.Enqueue("", to, template, locale, data)
+	return err
+}
+
+// Enqueue - Queue mail for delivery, the job of an earlier call with the same key is returned instead.
+// Keys of the caller are kept for Config.Retention, an empty key is derived from the content
+// and only kept for mailContentDedupe.
+func (q *MailQueue) Enqueue(key string, to string, template string, locale string, data map[string]string) (*model.MailJob, error) {
+	to = normalizeEmail(to)
+	id := uuid.NewString()
+	ttl, expiring := q.Expiring[template]
+	keep := q.Config.Retention
+	if key == "" {
+		key = contentKey(to, template, locale, data)
+		keep = mailContentDedupe
+		// A hash of a 6 digit code is as good as the code
+		if expiring {
+			key = id
+		}
+	}
+	ok, err := q.Storage.SetNX(mailIdempotencyKey(key), id, keep)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		existing, err := q.Storage.Get(mailIdempotencyKey(key))
+		if err != nil {
+			return nil, err
+		}
+		return q.Get(existing)
+	}
+	now := time.Now()
+	job := storedMailJob{
+		MailJob: model.MailJob{ID: id, Key: key, To: to, Template: template, Locale: locale,
+			Status: model.MailQueued, CreatedAt: now},
+		Data: data,
+	}
+	if expiring {
+		expiresAt := now.Add(ttl)
+		job.ExpiresAt = &expiresAt
+		job.Data = nil
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := q.Storage.Set(mailDataKey(id), string(encoded), ttl); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.put(&job); err != nil {
+		return nil, err
+	}
+	recipientKey := mailRecipientKey(to)
+	if err := q.Storage.SAdd(recipientKey, id); err != nil {
+		return nil, err
+	}
+	if err := q.Storage.Expire(recipientKey, q.Config.Retention); err != nil {
+		return nil, err
+	}
+	if err := q.Storage.ZAdd(mailQueueKey, score(now), id); err != nil {
+		return nil, err
+	}
+	return &job.MailJob, nil
+}
+
+// Run - Deliver due mail with Config.Workers workers until stop is closed
+func (q *MailQueue) Run(stop <-chan struct{}) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < q.Config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				if err := q.Process(id); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+	for {
+		ids, err := q.claimDue()
+		if err != nil {
+			log.Println(err.Error())
+		}
+		for _, id := range ids {
+			select {
+			case jobs <- id:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// claimDue - Due jobs no other worker holds, each is locked for mailLease
+func (q *MailQueue) claimDue() ([]string, error) {
+	ids, err := q.Storage.ZRangeByScore(mailQueueKey, score(time.Now()), int64(q.Config.Workers))
+	if err != nil {
+		return nil, err
+	}
+	claimed := []string{}
+	for _, id := range ids {
+		ok, err := q.Storage.SetNX(mailLockKey(id), "1", mailLease)
+		if err != nil {
+			return claimed, err
+		}
+		if !ok {
+			continue
+		}
+		// Out of the due range while claimed, it comes back when the worker dies
+		if err := q.Storage.ZAdd(mailQueueKey, score(time.Now().Add(mailLease)), id); err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, id)
+	}
+	return claimed, nil
+}
+
+// Process - Try to deliver a claimed job once
+func (q *MailQueue) Process(id string) error {
+	defer q.Storage.Del(mailLockKey(id))
+	job, err := q.get(id)
+	if errors.Is(err, ErrMailNotFound) {
+		// Expired before it was delivered
+		_, err := q.Storage.ZRem(mailQueueKey, id)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if job.Status == model.MailSent || job.Status == model.MailDead {
+		_, err := q.Storage.ZRem(mailQueueKey, id)
+		return err
+	}
+	now := time.Now()
+	// Claimed with a stale score, it waits for its retry
+	if job.NextAt != nil && job.NextAt.After(now) {
+		return q.Storage.ZAdd(mailQueueKey, score(*job.NextAt), id)
+	}
+	data, err := q.data(job, now)
+	if err != nil && !errors.Is(err, errMailExpired) {
+		return err
+	}
+	sendErr := err
+	if sendErr == nil {
+		job.Attempts++
+		sendErr = q.Sender.Send(job.To, job.Template, job.Locale, data)
+	}
+	next := now.Add(q.backoff(job.Attempts))
+	// A code that is no longer valid by the next attempt is not worth retrying
+	expiresFirst := job.ExpiresAt != nil && next.After(*job.ExpiresAt)
+	switch {
+	case sendErr == nil:
+		job.Status = model.MailSent
+		job.SentAt = &now
+		job.NextAt = nil
+		job.LastError = ""
+	case errors.Is(sendErr, errMailExpired) || expiresFirst || job.Attempts >= q.Config.MaxAttempts:
+		log.Printf("mail %s to %s dead after %d attempts: %s", job.ID, job.To, job.Attempts, sendErr.Error())
+		job.Status = model.MailDead
+		job.NextAt = nil
+		job.LastError = sendErr.Error()
+	default:
+		job.Status = model.MailRetrying
+		job.NextAt = &next
+		job.LastError = sendErr.Error()
+	}
+	if err := q.put(job); err != nil {
+		return err
+	}
+	if job.ExpiresAt != nil && job.Status != model.MailRetrying {
+		if _, err := q.Storage.Del(mailDataKey(id)); err != nil {
+			return err
+		}
+	}
+	if job.Status == model.MailRetrying {
+		return q.Storage.ZAdd(mailQueueKey, score(*job.NextAt), id)
+	}
+	if job.Status == model.MailDead {
+		if err := q.Storage.SAdd(mailDeadKey, id); err != nil {
+			return err
+		}
+		if err := q.Storage.Expire(mailDeadKey, q.Config.Retention); err != nil {
+			return err
+		}
+	}
+	_, err = q.Storage.ZRem(mailQueueKey, id)
+	return err
+}
+
+// data - Template data of the job, errMailExpired once the job is past ExpiresAt
+func (q *MailQueue) data(job *storedMailJob, now time.Time) (map[string]string, error) {
+	if job.ExpiresAt == nil {
+		return job.Data, nil
+	}
+	if !now.Before(*job.ExpiresAt) {
+		return nil, errMailExpired
+	}
+	encoded, err := q.Storage.Get(mailDataKey(job.ID))
+	if errors.Is(err, repository.ErrNil) {
+		return nil, errMailExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// backoff - Wait after the given number of failed attempts, Backoff doubled each time up to MaxBackoff
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	wait := q.Config.Backoff
+	for i := 1; i < attempts && wait < q.Config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > q.Config.MaxBackoff {
+		wait = q.Config.MaxBackoff
+	}
+	return wait
+}
+
+func (q *MailQueue) Get(id string) (*model.MailJob, error) {
+	job, err := q.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return &job.MailJob, nil
+}
+
+// ListByRecipient - Mail queued for the address within Config.Retention, newest first
+func (q *MailQueue) ListByRecipient(email string) ([]model.MailJob, error) {
+	return q.list(mailRecipientKey(normalizeEmail(email)))
+}
+
+// ListDead - Mail that ran out of attempts within Config.Retention, newest first
+func (q *MailQueue) ListDead() ([]model.MailJob, error) {
+	return q.list(mailDeadKey)
+}
+
+func (q *MailQueue) list(setKey string) ([]model.MailJob, error) {
+	ids, err := q.Storage.SMembers(setKey)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []model.MailJob{}
+	for _, id := range ids {
+		job, err := q.get(id)
+		if errors.Is(err, ErrMailNotFound) {
+			if err := q.Storage.SRem(setKey, id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job.MailJob)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+func (q *MailQueue) get(id string) (*storedMailJob, error) {
+	data, err := q.Storage.Get(mailJobKey(id))
+	if errors.Is(err, repository.ErrNil) {
+		return nil, ErrMailNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job storedMailJob
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *MailQueue) put(job *storedMailJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.Storage.Set(mailJobKey(job.ID), string(data), q.Config.Retention)
+}
+
+// storedMailJob - Job as kept in redis, the template data never leaves the queue.
+// Data of expiring mail is stored under mailDataKey instead.
+type storedMailJob struct {
+	model.MailJob
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// contentKey - Idempotency key of mail without one, json sorts the data keys
+func contentKey(to string, template string, locale string, data map[string]string) string {
+	encoded, _ := json.Marshal(data)
+	sum := sha256.Sum256([]byte(to + "\n" + template + "\n" + locale + "\n" + string(encoded)))
+	return hex.EncodeToString(sum[:])
+}
+
+func score(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func mailJobKey(id string) string {
+	return "mail:job:" + id
+}
+
+func mailLockKey(id string) string {
+	return "mail:lock:" + id
+}
+
+func mailRecipientKey(email string) string {
+	return "mail:to:" + email
+}
+
+func mailDataKey(id string) string {
+	return "mail:data:" + id
+}
+
+func mailIdempotencyKey(key string) string {
+	return "mail:idem:" + key
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSender - SMTP that is down
+type failingSender struct{}
+
+func (failingSender) Send(to string, template string, locale string, data map[string]string) error {
+	return errors.New("Connection refused")
+}
+
+func newTestMailQueue(sender MailSender, backoff time.Duration) (*MailQueue, *repository.MemoryStore) {
+	store := repository.NewMemoryStore()
+	queue := NewMailQueue(store, sender, config.MailQueueConfig{Workers: 1, MaxAttempts: 5, Backoff: backoff,
+		MaxBackoff: time.Hour, Retention: time.Hour})
+	queue.ExpireAfter(time.Minute, "code")
+	return queue, store
+}
+
+func TestCodeMailDataIsDropped(t *testing.T) {
+	mail := NewMemoryMailSender()
+	queue, store := newTestMailQueue(mail, time.Second)
+	job, err := queue.Enqueue("", "user@example.com", "code", "en", map[string]string{"code": "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ExpiresAt == nil || job.Key == contentKey("user@example.com", "code", "en", map[string]string{"code": "123456"}) {
+		t.Fatalf("queued %+v", job)
+	}
+	stored, err := store.Get(mailJobKey(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "123456") {
+		t.Fatalf("code kept with the job: %s", stored)
+	}
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := mail.Last("user@example.com"); sent.Data["code"] != "123456" {
+		t.Fatalf("sent %+v", sent)
+	}
+	if _, err := store.Get(mailDataKey(job.ID)); !errors.Is(err, repository.ErrNil) {
+		t.Fatalf("code kept after delivery: %v", err)
+	}
+}
+
+func TestCodeMailIsNotRetriedPastExpiry(t *testing.T) {
+	// The first retry would come after the code expired
+	queue, store := newTestMailQueue(failingSender{}, 2*time.Minute)
+	job, err := queue.Enqueue("", "user@example.com", "code", "en", map[string]string{"code": "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = queue.Get(job.ID); job.Status != model.MailDead || job.Attempts != 1 {
+		t.Fatalf("after the first failure %+v", job)
+	}
+	if _, err := store.Get(mailDataKey(job.ID)); !errors.Is(err, repository.ErrNil) {
+		t.Fatalf("code kept after dead-lettering: %v", err)
+	}
+
+	// Other mail is retried as before
+	job, err = queue.Enqueue("", "user@example.com", "welcome", "en", map[string]string{"name": "planty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = queue.Get(job.ID); job.Status != model.MailRetrying || job.ExpiresAt != nil {
+		t.Fatalf("after the first failure %+v", job)
+	}
+}
+
+func TestExpiredCodeMailIsDeadLettered(t *testing.T) {
+	mail := NewMemoryMailSender()
+	queue, store := newTestMailQueue(mail, time.Second)
+	queue.ExpireAfter(10*time.Millisecond, "code")
+	job, err := queue.Enqueue("", "user@example.com", "code", "en", map[string]string{"code": "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mail.Last("user@example.com"); ok {
+		t.Fatal("expired code was sent")
+	}
+	if job, _ = queue.Get(job.ID); job.Status != model.MailDead || job.Attempts != 0 {
+		t.Fatalf("expired job %+v", job)
+	}
+	dead, err := queue.ListDead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != job.ID {
+		t.Fatalf("dead letters %+v", dead)
+	}
+	if _, err := store.Get(mailDataKey(job.ID)); !errors.Is(err, repository.ErrNil) {
+		t.Fatalf("code kept after expiry: %v", err)
+	}
+}
+
+func TestRetryingMailWaitsForNextAt(t *testing.T) {
+	queue, store := newTestMailQueue(failingSender{}, time.Minute)
+	job, err := queue.Enqueue("", "user@example.com", "welcome", "en", map[string]string{"name": "planty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	// A worker holding a stale claim does not send before the backoff is over
+	if err := queue.Process(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = queue.Get(job.ID); job.Status != model.MailRetrying || job.Attempts != 1 {
+		t.Fatalf("after a stale claim %+v", job)
+	}
+	if due, _ := store.ZRangeByScore(mailQueueKey, score(time.Now()), 10); len(due) != 0 {
+		t.Fatalf("due before its retry: %v", due)
+	}
+	if _, err := store.Get(mailLockKey(job.ID)); !errors.Is(err, repository.ErrNil) {
+		t.Fatalf("claim kept: %v", err)
+	}
+}
@@ -0,0 +1,590 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/repository"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/oauth2"
+)
+
+// In-memory implementations of the storage and delivery services.
+// They let the handler run under httptest without MySQL, Redis, Gmail or OAuth providers.
+
+type MemoryUserDB struct {
+	mu             sync.Mutex
+	lastID         uint64
+	lastIdentityID uint64
+	users          map[uint64]model.User
+	identities     []model.Identity
+	roles          map[uint64][]string
+	totp           map[uint64]model.TOTPCredential
+	recoveryCodes  map[uint64][]model.RecoveryCode
+	Hasher         *PasswordHasher
+}
+
+func NewMemoryUserDB(hasher *PasswordHasher) *MemoryUserDB {
+	return &MemoryUserDB{users: map[uint64]model.User{}, roles: map[uint64][]string{},
+		totp: map[uint64]model.TOTPCredential{}, recoveryCodes: map[uint64][]model.RecoveryCode{}, Hasher: hasher}
+}
+
+func (db *MemoryUserDB) Post(user *model.User) error {
+	if user.Password != "" {
+		hash, err := db.Hasher.Hash(user.Password)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Same as the unique indexes of the users table, empty values are not indexed
+	for id, other := range db.users {
+		if id != user.ID && (sameKey(other.Email, user.Email) || sameKey(other.Nickname, user.Nickname)) {
+			return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		}
+	}
+	if user.ID == 0 {
+		db.lastID++
+		user.ID = db.lastID
+		user.CreatedAt = time.Now()
+	}
+	db.users[user.ID] = *user
+	return nil
+}
+
+func (db *MemoryUserDB) GetWithID(userID uint64) (*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[userID]
+	if !ok || user.DeletedAt != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+// Get - Match non-empty fields the same way gorm does with a struct condition
+func (db *MemoryUserDB) Get(filter *model.User) (*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, user := range db.users {
+		if user.DeletedAt != nil {
+			continue
+		}
+		if matchField(filter.Email, user.Email) && matchField(filter.Name, user.Name) &&
+			matchField(filter.Nickname, user.Nickname) && matchField(filter.Birth, user.Birth) {
+			found := user
+			return &found, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (db *MemoryUserDB) Authenticate(email string, password string) (*model.User, error) {
+	user := db.unscopedFind(func(u model.User) bool { return u.Email == email })
+	if user == nil {
+		db.Hasher.CompareDummy(password)
+		return nil, ErrInvalidCredentials
+	}
+	ok, err := db.Hasher.Compare(user.Password, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if user.DeletedAt != nil {
+		return user, ErrAccountDeleted
+	}
+	if user.SuspendedAt != nil {
+		return user, ErrAccountSuspended
+	}
+	if db.Hasher.NeedsRehash(user.Password) {
+		user.Password = password
+		if err := db.Post(user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (db *MemoryUserDB) Delete(id uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if user, ok := db.users[id]; ok && user.DeletedAt == nil {
+		now := time.Now()
+		user.DeletedAt = &now
+		db.users[id] = user
+	}
+	return nil
+}
+
+func (db *MemoryUserDB) Restore(id uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[id]
+	if !ok || user.DeletedAt == nil {
+		return ErrAccountNotDeleted
+	}
+	user.DeletedAt = nil
+	db.users[id] = user
+	return nil
+}
+
+func (db *MemoryUserDB) Purge(before time.Time) ([]uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ids := []uint64{}
+	for id, user := range db.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			ids = append(ids, id)
+			delete(db.users, id)
+			delete(db.totp, id)
+			delete(db.recoveryCodes, id)
+			delete(db.roles, id)
+		}
+	}
+	identities := db.identities[:0]
+	for _, identity := range db.identities {
+		if _, ok := db.users[identity.UserID]; ok {
+			identities = append(identities, identity)
+		}
+	}
+	db.identities = identities
+	return ids, nil
+}
+
+func (db *MemoryUserDB) UpdateProfile(userID uint64, update *model.ProfileUpdate) (*model.User, error) {
+	err := db.update(userID, func(user *model.User) error {
+		if update.Name != nil {
+			user.Name = *update.Name
+		}
+		if update.Nickname != nil {
+			user.Nickname = *update.Nickname
+		}
+		if update.Birth != nil {
+			user.Birth = *update.Birth
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetWithID(userID)
+}
+
+func (db *MemoryUserDB) ChangeEmail(userID uint64, email string) error {
+	return db.update(userID, func(user *model.User) error {
+		user.Email = email
+		return nil
+	})
+}
+
+func (db *MemoryUserDB) SetPassword(userID uint64, password string) error {
+	hash, err := db.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return db.update(userID, func(user *model.User) error {
+		user.Password = hash
+		return nil
+	})
+}
+
+// update - Change a user that is not deleted in place
+func (db *MemoryUserDB) update(userID uint64, change func(*model.User) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[userID]
+	if !ok || user.DeletedAt != nil {
+		return gorm.ErrRecordNotFound
+	}
+	if err := change(&user); err != nil {
+		return err
+	}
+	db.users[userID] = user
+	return nil
+}
+
+// unscopedFind - First user matching, deleted users included
+func (db *MemoryUserDB) unscopedFind(match func(model.User) bool) *model.User {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, user := range db.users {
+		if match(user) {
+			found := user
+			return &found
+		}
+	}
+	return nil
+}
+
+func (db *MemoryUserDB) Available(val string, key string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, user := range db.users {
+		switch key {
+		case "email":
+			if user.Email == val {
+				return false, nil
+			}
+		case "nickname":
+			if user.Nickname == val {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("Unknown column %s", key)
+		}
+	}
+	return true, nil
+}
+
+func (db *MemoryUserDB) GetByIdentity(provider string, providerUserID string) (*model.User, error) {
+	db.mu.Lock()
+	var userID uint64
+	for _, identity := range db.identities {
+		if identity.Provider == provider && identity.ProviderUserID == providerUserID {
+			userID = identity.UserID
+		}
+	}
+	db.mu.Unlock()
+	user := db.unscopedFind(func(u model.User) bool { return u.ID == userID })
+	if user == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if user.DeletedAt != nil {
+		return user, ErrAccountDeleted
+	}
+	if user.SuspendedAt != nil {
+		return user, ErrAccountSuspended
+	}
+	return user, nil
+}
+
+func (db *MemoryUserDB) ListUsers(query string, offset int, limit int) ([]model.User, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	matched := []model.User{}
+	for _, user := range db.users {
+		if user.DeletedAt != nil {
+			continue
+		}
+		if query == "" || strings.Contains(user.Email, query) || strings.Contains(user.Name, query) || strings.Contains(user.Nickname, query) {
+			matched = append(matched, user)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		matched = matched[offset : offset+limit]
+	} else {
+		matched = matched[offset:]
+	}
+	return matched, total, nil
+}
+
+func (db *MemoryUserDB) GetRoles(userID uint64) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string{}, db.roles[userID]...), nil
+}
+
+func (db *MemoryUserDB) SetRoles(userID uint64, roles []string) error {
+	for _, role := range roles {
+		if !model.ValidRole(role) {
+			return ErrUnknownRole
+		}
+	}
+	return db.update(userID, func(user *model.User) error {
+		sorted := append([]string{}, roles...)
+		sort.Strings(sorted)
+		db.roles[userID] = sorted
+		return nil
+	})
+}
+
+func (db *MemoryUserDB) Suspend(userID uint64) error {
+	return db.update(userID, func(user *model.User) error {
+		now := time.Now()
+		user.SuspendedAt = &now
+		return nil
+	})
+}
+
+func (db *MemoryUserDB) Unsuspend(userID uint64) error {
+	return db.update(userID, func(user *model.User) error {
+		user.SuspendedAt = nil
+		return nil
+	})
+}
+
+func (db *MemoryUserDB) GetTOTP(userID uint64) (*model.TOTPCredential, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	credential, ok := db.totp[userID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &credential, nil
+}
+
+func (db *MemoryUserDB) SaveTOTP(credential *model.TOTPCredential) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.totp[credential.UserID] = *credential
+	return nil
+}
+
+func (db *MemoryUserDB) DeleteTOTP(userID uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.totp, userID)
+	delete(db.recoveryCodes, userID)
+	return nil
+}
+
+func (db *MemoryUserDB) SetRecoveryCodes(userID uint64, hashes []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	codes := make([]model.RecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, model.RecoveryCode{UserID: userID, CodeHash: hash})
+	}
+	db.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (db *MemoryUserDB) UseRecoveryCode(userID uint64, hash string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, code := range db.recoveryCodes[userID] {
+		if code.CodeHash == hash && code.UsedAt == nil {
+			now := time.Now()
+			db.recoveryCodes[userID][i].UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *MemoryUserDB) CountRecoveryCodes(userID uint64) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	count := 0
+	for _, code := range db.recoveryCodes[userID] {
+		if code.UsedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *MemoryUserDB) LinkIdentity(identity *model.Identity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, existing := range db.identities {
+		if existing.Provider == identity.Provider && existing.ProviderUserID == identity.ProviderUserID {
+			if existing.UserID == identity.UserID {
+				return nil
+			}
+			return ErrIdentityInUse
+		}
+		if existing.UserID == identity.UserID && existing.Provider == identity.Provider {
+			return ErrProviderLinked
+		}
+	}
+	db.lastIdentityID++
+	identity.ID = db.lastIdentityID
+	identity.CreatedAt = time.Now()
+	db.identities = append(db.identities, *identity)
+	return nil
+}
+
+func (db *MemoryUserDB) UnlinkIdentity(userID uint64, provider string) error {
+	identities, err := db.ListIdentities(userID)
+	if err != nil {
+		return err
+	}
+	target, err := findIdentity(identities, provider)
+	if err != nil {
+		return err
+	}
+	user, err := db.GetWithID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Password == "" && len(identities) == 1 {
+		return ErrLastLoginMethod
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, identity := range db.identities {
+		if identity.ID == target.ID {
+			db.identities = append(db.identities[:i], db.identities[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (db *MemoryUserDB) ListIdentities(userID uint64) ([]model.Identity, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	identities := []model.Identity{}
+	for _, identity := range db.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func matchField(filter string, val string) bool {
+	return filter == "" || filter == val
+}
+
+// Mail - Message captured by MemoryMailSender
+type Mail struct {
+	To       string
+	Template string
+	Locale   string
+	Data     map[string]string
+}
+
+type MemoryMailSender struct {
+	mu     sync.Mutex
+	Outbox []Mail
+}
+
+func NewMemoryMailSender() *MemoryMailSender {
+	return &MemoryMailSender{}
+}
+
+func (m *MemoryMailSender) Send(to string, template string, locale string, data map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Outbox = append(m.Outbox, Mail{To: to, Template: template, Locale: locale, Data: data})
+	return nil
+}
+
+// Last - Most recent mail sent to the address
+func (m *MemoryMailSender) Last(to string) (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.Outbox) - 1; i >= 0; i-- {
+		if m.Outbox[i].To == to {
+			return m.Outbox[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+// MemoryOAuth - OAuth providers that accept codes registered in advance
+type MemoryOAuth struct {
+	mu        sync.Mutex
+	Storage   repository.KeyValueStore
+	providers map[string]bool
+	codes     map[string]model.OAuthProfile
+	tokens    map[string]model.OAuthProfile
+}
+
+func NewMemoryOAuth(store repository.KeyValueStore, providers ...string) *MemoryOAuth {
+	m := &MemoryOAuth{Storage: store, providers: map[string]bool{},
+		codes: map[string]model.OAuthProfile{}, tokens: map[string]model.OAuthProfile{}}
+	for _, provider := range providers {
+		m.providers[provider] = true
+	}
+	return m
+}
+
+// Register - Make Auth accept code and GetProfile return profile for it
+func (m *MemoryOAuth) Register(code string, profile model.OAuthProfile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code] = profile
+}
+
+// LoginURL - Callback URL carrying the state, the caller appends a registered code
+func (m *MemoryOAuth) LoginURL(provider string, app OAuthState) (string, error) {
+	if !m.providers[provider] {
+		return "", ErrUnknownProvider
+	}
+	state, _, err := saveOAuthState(m.Storage, provider, app)
+	if err != nil {
+		return "", err
+	}
+	return "/auth/" + provider + "/callback?state=" + state, nil
+}
+
+func (m *MemoryOAuth) Auth(provider string, r *http.Request) (*oauth2.Token, *OAuthState, error) {
+	if !m.providers[provider] {
+		return nil, nil, ErrUnknownProvider
+	}
+	oauthState, err := consumeOAuthState(m.Storage, provider, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := r.FormValue("code")
+	profile, ok := m.codes[code]
+	if !ok {
+		return nil, nil, fmt.Errorf("Invalid oauth code")
+	}
+	delete(m.codes, code)
+	accessToken := uuid.NewString()
+	m.tokens[accessToken] = profile
+	return &oauth2.Token{AccessToken: accessToken}, oauthState, nil
+}
+
+func (m *MemoryOAuth) GetProfile(provider string, token *oauth2.Token) (*model.OAuthProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.providers[provider] {
+		return nil, ErrUnknownProvider
+	}
+	profile, ok := m.tokens[token.AccessToken]
+	if !ok {
+		return nil, fmt.Errorf("Invalid oauth token")
+	}
+	return &profile, nil
+}
+
+func (m *MemoryOAuth) CreateLinkTicket(userID uint64, binding string) (string, error) {
+	return createLinkTicket(m.Storage, userID, binding)
+}
+
+func (m *MemoryOAuth) ConsumeLinkTicket(ticket string, binding string) (uint64, error) {
+	return consumeLinkTicket(m.Storage, ticket, binding)
+}
+
+// MemoryAuditor - Keep emitted audit events for inspection
+type MemoryAuditor struct {
+	mu     sync.Mutex
+	Events []AuditEvent
+}
+
+func NewMemoryAuditor() *MemoryAuditor {
+	return &MemoryAuditor{}
+}
+
+func (a *MemoryAuditor) Emit(event AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Events = append(a.Events, event)
+}
+
+func sameKey(a string, b string) bool {
+	return a != "" && strings.EqualFold(a, b)
+}
@@ -0,0 +1,417 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpPeriod = 30
+	// Codes of the previous and next period are accepted for clock drift
+	totpSkew           = 1
+	qrCodeSize         = 256
+	recoveryCodeLength = 10
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("Two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("Two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled = errors.New("Two-factor authentication has not been set up")
+	ErrInvalidTwoFactorCode = errors.New("Invalid two-factor code")
+	ErrInvalidMFAChallenge  = errors.New("Two-factor sign in has expired, sign in again")
+)
+
+// GetTOTP - Authenticator secret of the user, gorm.ErrRecordNotFound when there is none
+func (db *UserDB) GetTOTP(userID uint64) (*model.TOTPCredential, error) {
+	var credential model.TOTPCredential
+	if res := db.Storage.Where("user_id = ?", userID).First(&credential); res.Error != nil {
+		return nil, res.Error
+	}
+	return &credential, nil
+}
+
+// SaveTOTP - Create or replace the authenticator secret of the user
+func (db *UserDB) SaveTOTP(credential *model.TOTPCredential) error {
+	return db.Storage.Save(credential).Error
+}
+
+// DeleteTOTP - Turn two-factor sign in off, recovery codes go with the secret
+func (db *UserDB) DeleteTOTP(userID uint64) error {
+	return db.Storage.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Where("user_id = ?", userID).Delete(&model.TOTPCredential{}).Error
+	})
+}
+
+// SetRecoveryCodes - Replace the recovery codes of the user with the given hashes
+func (db *UserDB) SetRecoveryCodes(userID uint64, hashes []string) error {
+	return db.Storage.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}); res.Error != nil {
+			return res.Error
+		}
+		for _, hash := range hashes {
+			if res := tx.Create(&model.RecoveryCode{UserID: userID, CodeHash: hash}); res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode - Mark the unused code with hash as used, false when there is none
+func (db *UserDB) UseRecoveryCode(userID uint64, hash string) (bool, error) {
+	res := db.Storage.Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func (db *UserDB) CountRecoveryCodes(userID uint64) (int, error) {
+	count := 0
+	res := db.Storage.Model(&model.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count, res.Error
+}
+
+// TwoFactor - TOTP enrollment and the second step of sign in.
+// Sign in with a password hands out a challenge token instead of tokens,
+// it is traded for tokens with a code from the authenticator app or a recovery code.
+// Secrets are stored encrypted with KeyEncryptionKey, the same key the key ring uses.
+type TwoFactor struct {
+	Users            UserAPIService
+	Storage          repository.KeyValueStore
+	Config           config.TwoFactorConfig
+	KeyEncryptionKey string
+}
+
+type TwoFactorAPIService interface {
+	Enabled(userID uint64) (bool, error)
+	Status(userID uint64) (*model.TwoFactorStatus, error)
+	Enroll(user *model.User) (*model.TwoFactorEnrollment, error)
+	Confirm(userID uint64, code string) ([]string, error)
+	Disable(userID uint64, code string) error
+	RegenerateRecoveryCodes(userID uint64, code string) ([]string, error)
+	Challenge(userID uint64) (*model.MFAChallenge, error)
+	ChallengeUser(token string) (uint64, error)
+	CompleteChallenge(token string, code string) (uint64, error)
+}
+
+func NewTwoFactor(users UserAPIService, store repository.KeyValueStore, cfg config.TwoFactorConfig, keyEncryptionKey string) *TwoFactor {
+	return &TwoFactor{Users: users, Storage: store, Config: cfg, KeyEncryptionKey: keyEncryptionKey}
+}
+
+// Enabled - Whether the user confirmed an authenticator
+func (t *TwoFactor) Enabled(userID uint64) (bool, error) {
+	credential, err := t.Users.GetTOTP(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return credential.ConfirmedAt != nil, nil
+}
+
+func (t *TwoFactor) Status(userID uint64) (*model.TwoFactorStatus, error) {
+	enabled, err := t.Enabled(userID)
+	if err != nil || !enabled {
+		return &model.TwoFactorStatus{}, err
+	}
+	left, err := t.Users.CountRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.TwoFactorStatus{Enabled: true, RecoveryCodesLeft: left}, nil
+}
+
+// Enroll - New secret for the user, replacing one that was never confirmed
+func (t *TwoFactor) Enroll(user *model.User) (*model.TwoFactorEnrollment, error) {
+	enabled, err := t.Enabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	account := user.Email
+	if account == "" {
+		account = user.Nickname
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: t.Config.Issuer, AccountName: account, Period: totpPeriod})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := t.seal(user.ID, key.Secret())
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Users.SaveTOTP(&model.TOTPCredential{UserID: user.ID, Secret: sealed, CreatedAt: time.Now()}); err != nil {
+		return nil, err
+	}
+	image, err := qrPNG(key.URL())
+	if err != nil {
+		return nil, err
+	}
+	return &model.TwoFactorEnrollment{Secret: key.Secret(), URI: key.URL(), QRCode: image}, nil
+}
+
+// Confirm - Turn two-factor sign in on with a first code from the app, returns the recovery codes
+func (t *TwoFactor) Confirm(userID uint64, code string) ([]string, error) {
+	credential, err := t.Users.GetTOTP(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credential.ConfirmedAt != nil {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err := t.checkTOTP(credential, code); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	credential.ConfirmedAt = &now
+	if err := t.Users.SaveTOTP(credential); err != nil {
+		return nil, err
+	}
+	return t.newRecoveryCodes(userID)
+}
+
+// Disable - Turn two-factor sign in off, code may be a recovery code
+func (t *TwoFactor) Disable(userID uint64, code string) error {
+	if err := t.verify(userID, code); err != nil {
+		return err
+	}
+	return t.Users.DeleteTOTP(userID)
+}
+
+// RegenerateRecoveryCodes - Replace all recovery codes, code may be one of the old ones
+func (t *TwoFactor) RegenerateRecoveryCodes(userID uint64, code string) ([]string, error) {
+	if err := t.verify(userID, code); err != nil {
+		return nil, err
+	}
+	return t.newRecoveryCodes(userID)
+}
+
+// Challenge - Token for the second step of signing in as the user
+func (t *TwoFactor) Challenge(userID uint64) (*model.MFAChallenge, error) {
+	token := uuid.NewString()
+	if err := t.Storage.Set(mfaChallengeKey(token), strconv.FormatUint(userID, 10), t.Config.ChallengeTTL); err != nil {
+		return nil, err
+	}
+	return &model.MFAChallenge{MFARequired: true, MFAToken: token, ExpiresIn: int(t.Config.ChallengeTTL.Seconds())}, nil
+}
+
+// ChallengeUser - User signing in with the challenge, the code is not checked
+func (t *TwoFactor) ChallengeUser(token string) (uint64, error) {
+	val, err := t.Storage.Get(mfaChallengeKey(token))
+	if errors.Is(err, repository.ErrNil) {
+		return 0, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// CompleteChallenge - User id of the challenge once code is right.
+// The challenge is single use and burned after Config.MaxAttempts wrong codes,
+// failures across challenges are up to the LoginGuard.
+func (t *TwoFactor) CompleteChallenge(token string, code string) (uint64, error) {
+	userID, err := t.ChallengeUser(token)
+	if err != nil {
+		return 0, err
+	}
+	attempts, err := t.Storage.Incr(mfaAttemptsKey(token))
+	if err != nil {
+		return 0, err
+	}
+	if attempts == 1 {
+		if err := t.Storage.Expire(mfaAttemptsKey(token), t.Config.ChallengeTTL); err != nil {
+			return 0, err
+		}
+	}
+	if attempts > int64(t.Config.MaxAttempts) {
+		if _, err := t.Storage.Del(mfaChallengeKey(token), mfaAttemptsKey(token)); err != nil {
+			return 0, err
+		}
+		return 0, ErrTooManyAttempts
+	}
+	if err := t.verify(userID, code); err != nil {
+		return 0, err
+	}
+	// Whoever deletes the challenge first signs in
+	deleted, err := t.Storage.Del(mfaChallengeKey(token))
+	if err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, ErrInvalidMFAChallenge
+	}
+	if _, err := t.Storage.Del(mfaAttemptsKey(token)); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// verify - Check a code of the enabled authenticator, or use up a recovery code
+func (t *TwoFactor) verify(userID uint64, code string) error {
+	credential, err := t.Users.GetTOTP(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if credential.ConfirmedAt == nil {
+		return ErrTwoFactorNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == int(otp.DigitsSix) {
+		return t.checkTOTP(credential, code)
+	}
+	used, err := t.Users.UseRecoveryCode(userID, hashCode(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// checkTOTP - Validate code against the secret, a code is only accepted once
+func (t *TwoFactor) checkTOTP(credential *model.TOTPCredential, code string) error {
+	secret, err := t.open(credential)
+	if err != nil {
+		return err
+	}
+	valid, err := totp.ValidateCustom(code, secret, time.Now(), totp.ValidateOpts{
+		Period: totpPeriod, Skew: totpSkew, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil || !valid {
+		return ErrInvalidTwoFactorCode
+	}
+	// Long enough to outlive every period the code is valid in
+	ttl := time.Duration(totpPeriod*(2*totpSkew+1)) * time.Second
+	fresh, err := t.Storage.SetNX(totpUsedKey(credential.UserID, code), "1", ttl)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// seal - Encrypt the secret of the user for the database, the user id is authenticated with it
+func (t *TwoFactor) seal(userID uint64, secret string) (string, error) {
+	aead, err := newAEAD(t.KeyEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(totpSecretAD(userID)))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open - Decrypt the secret of a credential
+func (t *TwoFactor) open(credential *model.TOTPCredential) (string, error) {
+	aead, err := newAEAD(t.KeyEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(credential.Secret)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("Invalid authenticator secret of user %d", credential.UserID)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, []byte(totpSecretAD(credential.UserID)))
+	if err != nil {
+		return "", fmt.Errorf("Cannot decrypt authenticator secret of user %d, check the key encryption key", credential.UserID)
+	}
+	return string(secret), nil
+}
+
+// newRecoveryCodes - Generate Config.RecoveryCodes codes, only their hashes are stored
+func (t *TwoFactor) newRecoveryCodes(userID uint64) ([]string, error) {
+	codes := make([]string, 0, t.Config.RecoveryCodes)
+	hashes := make([]string, 0, t.Config.RecoveryCodes)
+	for i := 0; i < t.Config.RecoveryCodes; i++ {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf))[:recoveryCodeLength]
+		codes = append(codes, raw[:recoveryCodeLength/2]+"-"+raw[recoveryCodeLength/2:])
+		hashes = append(hashes, hashCode(raw))
+	}
+	if err := t.Users.SetRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode - Codes may be typed in any case, with or without the dash
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// qrPNG - Base64 PNG of a QR code holding content
+func qrPNG(content string) (string, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+	code, err = barcode.Scale(code, qrCodeSize, qrCodeSize)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func totpSecretAD(userID uint64) string {
+	return "totp:" + strconv.FormatUint(userID, 10)
+}
+
+func mfaChallengeKey(token string) string {
+	return "mfa:challenge:" + token
+}
+
+func mfaAttemptsKey(token string) string {
+	return "mfa:attempts:" + token
+}
+
+func totpUsedKey(userID uint64, code string) string {
+	return "mfa:used:" + strconv.FormatUint(userID, 10) + ":" + code
+}
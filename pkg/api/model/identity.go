@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// Identity - External account a user signs in with, unique per provider
+type Identity struct {
+	ID             uint64    `json:"-"`
+	UserID         uint64    `json:"-" gorm:"index"`
+	Provider       string    `json:"provider" gorm:"unique_index:idx_identities_provider_user"`
+	ProviderUserID string    `json:"-" gorm:"unique_index:idx_identities_provider_user"`
+	Email          string    `json:"email"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// OAuthProfile - Profile returned by a provider, mapped to our user fields
+type OAuthProfile struct {
+	ProviderUserID string
+	User           User
+}
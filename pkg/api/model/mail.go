@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+const (
+	MailQueued   = "queued"
+	MailRetrying = "retrying"
+	MailSent     = "sent"
+	MailDead     = "dead"
+)
+
+// MailJob - Delivery state of a queued mail, template data is left out since it holds codes.
+// Mail with ExpiresAt is dead-lettered instead of sent late.
+type MailJob struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"idempotency_key"`
+	To        string     `json:"to"`
+	Template  string     `json:"template"`
+	Locale    string     `json:"locale,omitempty"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	NextAt    *time.Time `json:"next_attempt_at,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// MailQuery - Mail sent to an address, or every dead-lettered mail
+type MailQuery struct {
+	To     string `form:"to" binding:"required_without=Status,omitempty,email"`
+	Status string `form:"status" binding:"omitempty,oneof=dead"`
+}
@@ -0,0 +1,55 @@
+package model
+
+import "time"
+
+// TOTPCredential - Authenticator app secret of a user, two-factor sign in is on once it is confirmed
+type TOTPCredential struct {
+	UserID      uint64 `gorm:"primary_key;auto_increment:false"`
+	Secret      string
+	ConfirmedAt *time.Time
+	CreatedAt   time.Time
+}
+
+// RecoveryCode - Single use code for signing in without the authenticator, only its hash is stored
+type RecoveryCode struct {
+	ID       uint64
+	UserID   uint64 `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+// TwoFactorStatus - Body of GET /users/me/2fa
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// TwoFactorEnrollment - Secret to add to an authenticator app, QRCode is a base64 PNG of URI
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode string `json:"qr_png"`
+}
+
+// RecoveryCodes - Shown once when two-factor sign in is confirmed or the codes are replaced
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// MFAChallenge - Returned by sign in instead of tokens when the account has two-factor sign in on
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// TwoFactorCodeRequest - Code from the authenticator app, or a recovery code where allowed
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required,max=32"`
+}
+
+// MFALoginRequest - Second step of sign in with the token of MFAChallenge
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required,max=32"`
+}
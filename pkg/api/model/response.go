@@ -5,6 +5,39 @@ type LoginResponse struct {
 	User  User  `json:"user"`
 }
 
+// ErrorResponse - Body of every error response, clients branch on Code
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// FieldError - One rejected field of a request, Rule is the failed validation tag
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// UserPage - One page of an admin user search
+type UserPage struct {
+	Users []User `json:"users"`
+	Total int    `json:"total"`
+	Page  int    `json:"page"`
+	Size  int    `json:"size"`
+}
+
+// LinkResponse - The app opens URL in a browser with a form post of ticket
+type LinkResponse struct {
+	URL    string `json:"url"`
+	Ticket string `json:"ticket"`
+}
+
+type VerificationResponse struct {
+	Ticket string `json:"ticket"`
+}
+
 type OAuthResponse struct {
 	Resultcode string      `json:"resultcode"`
 	Message    string      `json:"message"`
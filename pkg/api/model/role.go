@@ -0,0 +1,49 @@
+package model
+
+import "sort"
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+const (
+	PermissionUsersRead    = "users:read"
+	PermissionUsersSuspend = "users:suspend"
+	PermissionRolesWrite   = "roles:write"
+	PermissionMailRead     = "mail:read"
+)
+
+// RolePermissions - What each role is allowed to do, users without roles have none of these
+var RolePermissions = map[string][]string{
+	RoleAdmin:     {PermissionUsersRead, PermissionUsersSuspend, PermissionRolesWrite, PermissionMailRead},
+	RoleModerator: {PermissionUsersRead, PermissionUsersSuspend, PermissionMailRead},
+}
+
+// UserRole - Role granted to a user
+type UserRole struct {
+	UserID uint64 `gorm:"primary_key;auto_increment:false"`
+	Role   string `gorm:"primary_key"`
+}
+
+// ValidRole - Role is one of RolePermissions
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// PermissionsOf - Union of the permissions of roles, sorted
+func PermissionsOf(roles []string) []string {
+	set := map[string]struct{}{}
+	for _, role := range roles {
+		for _, permission := range RolePermissions[role] {
+			set[permission] = struct{}{}
+		}
+	}
+	permissions := make([]string, 0, len(set))
+	for permission := range set {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// DeviceInfo - Client a login was made from
+type DeviceInfo struct {
+	DeviceName string `json:"device_name"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+}
+
+// Session - One login of a user, shared by all tokens rotated from it
+type Session struct {
+	ID string `json:"session_id"`
+	DeviceInfo
+	UserID     uint64    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
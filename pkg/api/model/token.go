@@ -5,6 +5,20 @@ type Token struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// JWK - Public RSA key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
 type TokenMetaData struct {
 	AccessUUID   string
 	AccessToken  string
@@ -12,5 +26,21 @@ type TokenMetaData struct {
 	RefreshUUID  string
 	RefreshToken string
 	RtExpire     int64
+	FamilyID     string
 	UserID       uint64
+	Roles        []string
+	Permissions  []string
+	Device       DeviceInfo
+}
+
+// ExchangeRequest - The app trades the code from the OAuth callback and its PKCE verifier for tokens
+type ExchangeRequest struct {
+	Code         string `json:"code" binding:"required"`
+	CodeVerifier string `json:"code_verifier" binding:"required,min=43,max=128"`
+	RedirectURI  string `json:"redirect_uri"`
+}
+
+// RefreshRequest - Body of token refresh
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
@@ -1,10 +1,122 @@
 package model
 
+import "time"
+
+// User - DeletedAt makes gorm soft delete, deleted users are left out of queries until purged.
+// Only fields tagged view:"public" are shown to other users, see Public.
+// A suspended user cannot sign in until an admin lifts the suspension.
 type User struct {
-	ID       uint64 `json:"user_id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Name     string `json:"name"`
-	Nickname string `json:"nickname"`
-	Birth    string `json:"birth"`
+	ID          uint64     `json:"user_id" view:"public"`
+	Email       string     `json:"email"`
+	Password    string     `json:"-"`
+	Name        string     `json:"name"`
+	Nickname    string     `json:"nickname" view:"public"`
+	Avatar      string     `json:"avatar" view:"public"`
+	Birth       string     `json:"birth"`
+	CreatedAt   time.Time  `json:"created_at" view:"public"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	DeletedAt   *time.Time `json:"-" sql:"index"`
+}
+
+// Public - Profile as other users see it
+func (u User) Public() map[string]interface{} {
+	return publicView(u)
+}
+
+// RegisterRequest - Body of local sign up, password is only accepted here.
+// Ticket is returned by email verification and must match the email.
+type RegisterRequest struct {
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" binding:"required,password"`
+	Name     string `json:"name" binding:"max=50"`
+	Nickname string `json:"nickname" binding:"required,nickname"`
+	Birth    string `json:"birth" binding:"birthdate"`
+	Ticket   string `json:"ticket" binding:"required"`
+}
+
+// User - Account to create for the request
+func (r *RegisterRequest) User() User {
+	return User{Email: r.Email, Password: r.Password, Name: r.Name, Nickname: r.Nickname, Birth: r.Birth}
+}
+
+// Credentials - Body of local login, the password policy is not checked
+// so accounts from before it existed can still sign in
+type Credentials struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+// DeleteAccountRequest - Account deletion is confirmed with the password,
+// or with an email verification ticket for users without one
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required_without=Ticket"`
+	Ticket   string `json:"ticket" binding:"required_without=Password"`
+}
+
+// ProfileUpdate - Fields of PATCH /users/me, nil fields are left unchanged
+type ProfileUpdate struct {
+	Name     *string `json:"name" binding:"omitempty,max=50"`
+	Nickname *string `json:"nickname" binding:"omitempty,nickname"`
+	Birth    *string `json:"birth" binding:"omitempty,birthdate"`
+}
+
+// PasswordChangeRequest - Users that never had a password confirm with an email verification ticket
+// instead of CurrentPassword
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Ticket          string `json:"ticket"`
+	NewPassword     string `json:"new_password" binding:"required,password"`
+}
+
+// EmailChangeRequest - Ticket is returned by verifying a code sent to the new email.
+// The switch also takes CurrentPassword, or CurrentTicket for the current email from users without a password.
+type EmailChangeRequest struct {
+	Email           string `json:"email" binding:"required,email,max=254"`
+	Ticket          string `json:"ticket"`
+	CurrentPassword string `json:"current_password"`
+	CurrentTicket   string `json:"current_ticket"`
+}
+
+// EmailQuery - ?email= of sending a sign up code
+type EmailQuery struct {
+	Email string `form:"email" binding:"required,email,max=254"`
+}
+
+// NicknameQuery - ?nickname= of the availability check
+type NicknameQuery struct {
+	Nickname string `form:"nickname" binding:"required,nickname"`
+}
+
+// VerifyCodeRequest - Code mailed to the address, exchanged for a ticket
+type VerifyCodeRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Code  string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// ForgotPasswordRequest - Address a password reset code is sent to
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// UnlockCodeRequest - Address an unlock code is sent to
+type UnlockCodeRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// UnlockRequest - Code is the one mailed for the unlock
+type UnlockRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Code  string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// ResetPasswordRequest - Code is the one mailed by forgot password
+type ResetPasswordRequest struct {
+	Email       string `json:"email" binding:"required,email"`
+	Code        string `json:"code" binding:"required,len=6,numeric"`
+	NewPassword string `json:"new_password" binding:"required,password"`
+}
+
+// RolesRequest - Roles that replace the current roles of a user
+type RolesRequest struct {
+	Roles []string `json:"roles" binding:"dive,required"`
 }
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules of the custom binding tags password, nickname and birthdate
+const (
+	PasswordMinLength = 8
+	// bcrypt ignores everything after 72 bytes
+	PasswordMaxBytes  = 72
+	NicknameMinLength = 2
+	NicknameMaxLength = 16
+	BirthDateLayout   = "2006-01-02"
+)
+
+// ValidPassword - At least PasswordMinLength characters with a letter and a digit
+func ValidPassword(password string) bool {
+	if utf8.RuneCountInString(password) < PasswordMinLength || len(password) > PasswordMaxBytes {
+		return false
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			return false
+		}
+	}
+	return letter && digit
+}
+
+// ValidNickname - Hangul syllables, latin letters, digits and _
+func ValidNickname(nickname string) bool {
+	length := utf8.RuneCountInString(nickname)
+	if length < NicknameMinLength || length > NicknameMaxLength {
+		return false
+	}
+	for _, r := range nickname {
+		switch {
+		case r >= '가' && r <= '힣':
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidBirthDate - Empty, or an ISO date (YYYY-MM-DD) that is not in the future
+func ValidBirthDate(birth string) bool {
+	if birth == "" {
+		return true
+	}
+	date, err := time.Parse(BirthDateLayout, birth)
+	if err != nil {
+		return false
+	}
+	return date.Year() >= 1900 && !date.After(time.Now())
+}
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+)
+
+// publicView - Fields of struct v tagged view:"public", keyed by their json name.
+// Untagged fields are private so a new field is never exposed by accident.
+func publicView(v interface{}) map[string]interface{} {
+	view := map[string]interface{}{}
+	val := reflect.ValueOf(v)
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Tag.Get("view") != "public" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+		view[name] = val.Field(i).Interface()
+	}
+	return view
+}
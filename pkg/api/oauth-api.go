@@ -2,69 +2,220 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"sort"
 	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/oauth2"
 )
 
-type NaverOAuth struct {
-	Config *oauth2.Config
-	State  string
+var (
+	ErrUnknownProvider   = errors.New("Unknown oauth provider")
+	ErrInvalidLinkTicket = errors.New("Invalid or expired link ticket")
+)
+
+// LinkTicketTTL - Link tickets carry a logged in user through the provider round trip
+const LinkTicketTTL = 10 * time.Minute
+
+// OAuthProvider - Endpoints, scopes and profile mapping of one sign in provider.
+// When ProfileURL is empty the profile is read from the id_token of the token response.
+type OAuthProvider struct {
+	Name       string
+	Config     *oauth2.Config
+	ProfileURL string
+	AuthParams []oauth2.AuthCodeOption
+	MapProfile func(data []byte) (*model.OAuthProfile, error)
+}
+
+type OAuthAPIService interface {
+	LoginURL(provider string, app OAuthState) (string, error)
+	Auth(provider string, r *http.Request) (*oauth2.Token, *OAuthState, error)
+	GetProfile(provider string, token *oauth2.Token) (*model.OAuthProfile, error)
+	CreateLinkTicket(userID uint64, binding string) (string, error)
+	ConsumeLinkTicket(ticket string, binding string) (uint64, error)
+}
+
+// OAuthRegistry - Providers available for sign in, keyed by name used in routes
+type OAuthRegistry struct {
+	Providers map[string]*OAuthProvider
+	Storage   repository.KeyValueStore
+}
+
+// NewOAuthRegistry - Register every provider that has a client id configured
+func NewOAuthRegistry(cfg config.OAuthProvidersConfig, publicURL string, store repository.KeyValueStore) *OAuthRegistry {
+	registry := &OAuthRegistry{Providers: map[string]*OAuthProvider{}, Storage: store}
+	candidates := []*OAuthProvider{
+		NewNaverProvider(cfg.Naver),
+		NewKakaoProvider(cfg.Kakao),
+		NewGoogleProvider(cfg.Google),
+		NewAppleProvider(cfg.Apple),
+	}
+	for _, provider := range candidates {
+		if provider.Config.ClientID == "" {
+			continue
+		}
+		if provider.Config.RedirectURL == "" {
+			provider.Config.RedirectURL = fmt.Sprintf("%s/auth/%s/callback", publicURL, provider.Name)
+		}
+		registry.Register(provider)
+	}
+	return registry
+}
+
+func (o *OAuthRegistry) Register(provider *OAuthProvider) {
+	o.Providers[provider.Name] = provider
 }
 
-type NaverAPIService interface {
-	Auth(http.ResponseWriter, *http.Request) (*model.Token, error)
-	GetUser(*model.Token) (*model.User, error)
+// Names - Registered provider names in order
+func (o *OAuthRegistry) Names() []string {
+	names := make([]string, 0, len(o.Providers))
+	for name := range o.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// NewNaverService - Create Naver OAuth
-func NewNaverService() *NaverOAuth {
-	config := &oauth2.Config{
-		ClientID:     os.Getenv("NAVER_ID"),
-		ClientSecret: os.Getenv("NAVER_SECRET"),
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://nid.naver.com/oauth2.0/authorize",
-			TokenURL: "https://nid.naver.com/oauth2.0/token",
-		},
-		RedirectURL: "http://localhost:8080/auth/naver/callback",
-		Scopes:      []string{"email", "name", "nickname", "birth"},
+// LoginURL - Consent page of the provider with a new state and PKCE challenge.
+// app carries what the app asked for, provider and verifier are filled in here.
+func (o *OAuthRegistry) LoginURL(name string, app OAuthState) (string, error) {
+	provider, ok := o.Providers[name]
+	if !ok {
+		return "", ErrUnknownProvider
 	}
-	return &NaverOAuth{
-		Config: config,
-		State:  os.Getenv("ACCESS_SECRET"),
+	state, oauthState, err := saveOAuthState(o.Storage, name, app)
+	if err != nil {
+		return "", err
 	}
+	opts := append([]oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(oauthState.CodeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}, provider.AuthParams...)
+	return provider.Config.AuthCodeURL(state, opts...), nil
 }
 
-// Auth - Get tokens from naver
-func (n *NaverOAuth) Auth(w http.ResponseWriter, r http.Request) (*model.Token, error) {
-	if r.FormValue("state") != n.State {
-		return nil, fmt.Errorf("Invalid oauth state")
+// Auth - Consume the state of the callback and exchange its code for provider tokens
+func (o *OAuthRegistry) Auth(name string, r *http.Request) (*oauth2.Token, *OAuthState, error) {
+	provider, ok := o.Providers[name]
+	if !ok {
+		return nil, nil, ErrUnknownProvider
+	}
+	oauthState, err := consumeOAuthState(o.Storage, name, r)
+	if err != nil {
+		return nil, nil, err
 	}
 	code := r.FormValue("code")
 	client := &http.Client{Timeout: 2 * time.Second}
-	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, client)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
 
-	token, err := n.Config.Exchange(ctx, code)
+	token, err := provider.Config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", oauthState.CodeVerifier))
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, oauthState, nil
+}
+
+// GetProfile - Fetch profile from the provider and map it to a user
+func (o *OAuthRegistry) GetProfile(name string, token *oauth2.Token) (*model.OAuthProfile, error) {
+	provider, ok := o.Providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	var data []byte
+	var err error
+	if provider.ProfileURL == "" {
+		data, err = idTokenClaims(token)
+	} else {
+		data, err = fetchProfile(provider, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile, err := provider.MapProfile(data)
 	if err != nil {
 		return nil, err
 	}
-	return &model.Token{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}, nil
+	if profile.ProviderUserID == "" {
+		return nil, fmt.Errorf("%s profile has no user id", provider.Name)
+	}
+	return profile, nil
+}
+
+// linkTicket - Stored under the ticket, BrowserBinding is the hash of the OAuthLinkCookie it was handed out with
+type linkTicket struct {
+	UserID         uint64 `json:"user_id"`
+	BrowserBinding string `json:"browser_binding"`
+}
+
+// CreateLinkTicket - Ticket that makes the next callback link the provider to userID.
+// It is only accepted from the browser holding binding, a ticket posted from another browser
+// would link the account of whoever signs in there.
+func (o *OAuthRegistry) CreateLinkTicket(userID uint64, binding string) (string, error) {
+	return createLinkTicket(o.Storage, userID, binding)
+}
+
+// ConsumeLinkTicket - User the ticket was made for, the ticket can be used once
+func (o *OAuthRegistry) ConsumeLinkTicket(ticket string, binding string) (uint64, error) {
+	return consumeLinkTicket(o.Storage, ticket, binding)
+}
+
+func createLinkTicket(store repository.KeyValueStore, userID uint64, binding string) (string, error) {
+	ticket := uuid.NewString()
+	data, err := json.Marshal(linkTicket{UserID: userID, BrowserBinding: hashCode(binding)})
+	if err != nil {
+		return "", err
+	}
+	if err := store.Set(linkTicketKey(ticket), string(data), LinkTicketTTL); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+func consumeLinkTicket(store repository.KeyValueStore, ticket string, binding string) (uint64, error) {
+	val, err := store.Get(linkTicketKey(ticket))
+	if errors.Is(err, repository.ErrNil) {
+		return 0, ErrInvalidLinkTicket
+	}
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := store.Del(linkTicketKey(ticket))
+	if err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, ErrInvalidLinkTicket
+	}
+	var stored linkTicket
+	if err := json.Unmarshal([]byte(val), &stored); err != nil {
+		return 0, err
+	}
+	if binding == "" || subtle.ConstantTimeCompare([]byte(hashCode(binding)), []byte(stored.BrowserBinding)) != 1 {
+		return 0, ErrInvalidLinkTicket
+	}
+	return stored.UserID, nil
+}
+
+func linkTicketKey(ticket string) string {
+	return "oauth:link:" + ticket
 }
 
-// GetUser - Get user from naver
-func (n *NaverOAuth) GetUser(token *model.Token) (*model.User, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://openapi.naver.com/v1/nid/me", nil)
+func fetchProfile(provider *OAuthProvider, token *oauth2.Token) ([]byte, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest("GET", provider.ProfileURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Host", "openapi.naver.com")
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
 	req.Header.Set("Accept", "*/*")
@@ -78,10 +229,8 @@ func (n *NaverOAuth) GetUser(token *model.Token) (*model.User, error) {
 	if err != nil {
 		return nil, err
 	}
-	var oauthRes model.OAuthResponse
-	if err := json.Unmarshal(body, &oauthRes); err != nil {
-		return nil, err
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s profile request failed with %d", provider.Name, res.StatusCode)
 	}
-	userRes := oauthRes.Response
-	return &model.User{Email: userRes.Email, Name: userRes.Name, Nickname: userRes.Nickname, Birth: userRes.Birthyear + "-" + userRes.Birthday}, nil
+	return body, nil
 }
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+func NewNaverProvider(cfg config.OAuthConfig) *OAuthProvider {
+	return &OAuthProvider{
+		Name: "naver",
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://nid.naver.com/oauth2.0/authorize",
+				TokenURL: "https://nid.naver.com/oauth2.0/token",
+			},
+			RedirectURL: cfg.RedirectURL,
+			Scopes:      []string{"email", "name", "nickname", "birth"},
+		},
+		ProfileURL: "https://openapi.naver.com/v1/nid/me",
+		MapProfile: mapNaverProfile,
+	}
+}
+
+func NewKakaoProvider(cfg config.OAuthConfig) *OAuthProvider {
+	return &OAuthProvider{
+		Name: "kakao",
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://kauth.kakao.com/oauth/authorize",
+				TokenURL:  "https://kauth.kakao.com/oauth/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			RedirectURL: cfg.RedirectURL,
+			Scopes:      []string{"account_email", "profile_nickname", "name", "birthyear", "birthday"},
+		},
+		ProfileURL: "https://kapi.kakao.com/v2/user/me",
+		MapProfile: mapKakaoProfile,
+	}
+}
+
+func NewGoogleProvider(cfg config.OAuthConfig) *OAuthProvider {
+	return &OAuthProvider{
+		Name: "google",
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURL: "https://oauth2.googleapis.com/token",
+			},
+			RedirectURL: cfg.RedirectURL,
+			Scopes:      []string{"openid", "email", "profile"},
+		},
+		ProfileURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		MapProfile: mapGoogleProfile,
+	}
+}
+
+// NewAppleProvider - Sign in with Apple.
+// ClientSecret is the ES256 client secret JWT generated from the Apple key, Apple only
+// returns the profile inside the id_token and posts the callback as a form.
+func NewAppleProvider(cfg config.OAuthConfig) *OAuthProvider {
+	return &OAuthProvider{
+		Name: "apple",
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://appleid.apple.com/auth/authorize",
+				TokenURL:  "https://appleid.apple.com/auth/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			RedirectURL: cfg.RedirectURL,
+			Scopes:      []string{"name", "email"},
+		},
+		AuthParams: []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("response_mode", "form_post")},
+		MapProfile: mapAppleProfile,
+	}
+}
+
+func mapNaverProfile(data []byte) (*model.OAuthProfile, error) {
+	var oauthRes model.OAuthResponse
+	if err := json.Unmarshal(data, &oauthRes); err != nil {
+		return nil, err
+	}
+	userRes := oauthRes.Response
+	return &model.OAuthProfile{
+		ProviderUserID: userRes.ID,
+		User: model.User{Email: userRes.Email, Name: userRes.Name, Nickname: userRes.Nickname,
+			Avatar: userRes.ProfileImage, Birth: userRes.Birthyear + "-" + userRes.Birthday},
+	}, nil
+}
+
+type kakaoProfile struct {
+	ID           int64 `json:"id"`
+	KakaoAccount struct {
+		Email     string `json:"email"`
+		Name      string `json:"name"`
+		Birthyear string `json:"birthyear"`
+		Birthday  string `json:"birthday"`
+		Profile   struct {
+			Nickname        string `json:"nickname"`
+			ProfileImageURL string `json:"profile_image_url"`
+		} `json:"profile"`
+	} `json:"kakao_account"`
+}
+
+func mapKakaoProfile(data []byte) (*model.OAuthProfile, error) {
+	var profile kakaoProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	account := profile.KakaoAccount
+	user := model.User{Email: account.Email, Name: account.Name, Nickname: account.Profile.Nickname,
+		Avatar: account.Profile.ProfileImageURL}
+	// Kakao sends the birthday as MMDD
+	if account.Birthyear != "" && len(account.Birthday) == 4 {
+		user.Birth = account.Birthyear + "-" + account.Birthday[:2] + "-" + account.Birthday[2:]
+	}
+	return &model.OAuthProfile{ProviderUserID: strconv.FormatInt(profile.ID, 10), User: user}, nil
+}
+
+type googleProfile struct {
+	Sub     string `json:"sub"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Picture string `json:"picture"`
+}
+
+func mapGoogleProfile(data []byte) (*model.OAuthProfile, error) {
+	var profile googleProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	return &model.OAuthProfile{ProviderUserID: profile.Sub, User: model.User{Email: profile.Email, Name: profile.Name, Avatar: profile.Picture}}, nil
+}
+
+type appleClaims struct {
+	Sub   string `json:"sub"`
+	Email string `json:"email"`
+}
+
+func mapAppleProfile(data []byte) (*model.OAuthProfile, error) {
+	var claims appleClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	return &model.OAuthProfile{ProviderUserID: claims.Sub, User: model.User{Email: claims.Email}}, nil
+}
+
+// idTokenClaims - Payload of the id_token in the token response.
+// The token comes straight from the provider's token endpoint over TLS,
+// which OpenID Connect accepts in place of checking its signature.
+func idTokenClaims(token *oauth2.Token) ([]byte, error) {
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("Missing id_token")
+	}
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed id_token")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pdserver/pkg/repository"
+	"time"
+)
+
+const (
+	// States only live for one trip to the provider and back
+	OAuthStateTTL = 10 * time.Minute
+	// OAuthBindingCookie - Set on the browser that starts a login, the callback must come from the same browser
+	OAuthBindingCookie = "oauth_binding"
+	// OAuthLinkCookie - Set on the browser a link ticket is handed to, only that browser can post the ticket
+	OAuthLinkCookie = "oauth_link"
+)
+
+var ErrInvalidOAuthState = errors.New("Invalid or expired oauth state")
+
+// OAuthState - What a login started with, looked up by the state parameter on callback.
+// LinkUserID is set when the login links the provider to an existing user.
+// CodeVerifier is ours for the provider, AppCodeChallenge is the app's for the handoff code.
+// Restore allows signing in to an account scheduled for deletion, which cancels the deletion.
+// BrowserBinding is the value of the OAuthBindingCookie of the login, it is stored hashed.
+type OAuthState struct {
+	Provider         string `json:"provider"`
+	CodeVerifier     string `json:"code_verifier"`
+	LinkUserID       uint64 `json:"link_user_id,omitempty"`
+	AppRedirectURI   string `json:"app_redirect_uri"`
+	AppCodeChallenge string `json:"app_code_challenge,omitempty"`
+	Restore          bool   `json:"restore,omitempty"`
+	BrowserBinding   string `json:"browser_binding"`
+}
+
+// saveOAuthState - Store app with a fresh PKCE verifier and return the state parameter
+func saveOAuthState(store repository.KeyValueStore, provider string, app OAuthState) (string, *OAuthState, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	oauthState := &app
+	oauthState.Provider = provider
+	oauthState.CodeVerifier = verifier
+	oauthState.BrowserBinding = hashCode(app.BrowserBinding)
+	data, err := json.Marshal(oauthState)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := store.Set(oauthStateKey(state), string(data), OAuthStateTTL); err != nil {
+		return "", nil, err
+	}
+	return state, oauthState, nil
+}
+
+// consumeOAuthState - Load state for the callback, each state can be used exactly once
+// and only by the browser that started the login
+func consumeOAuthState(store repository.KeyValueStore, provider string, r *http.Request) (*OAuthState, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return nil, ErrInvalidOAuthState
+	}
+	data, err := store.Get(oauthStateKey(state))
+	if errors.Is(err, repository.ErrNil) {
+		return nil, ErrInvalidOAuthState
+	}
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := store.Del(oauthStateKey(state))
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, ErrInvalidOAuthState
+	}
+	var oauthState OAuthState
+	if err := json.Unmarshal([]byte(data), &oauthState); err != nil {
+		return nil, err
+	}
+	if oauthState.Provider != provider {
+		return nil, ErrInvalidOAuthState
+	}
+	binding, err := r.Cookie(OAuthBindingCookie)
+	if err != nil || binding.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(hashCode(binding.Value)), []byte(oauthState.BrowserBinding)) != 1 {
+		return nil, ErrInvalidOAuthState
+	}
+	return &oauthState, nil
+}
+
+// codeChallenge - S256 PKCE challenge of verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomToken - 256 bit random value, URL safe
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func oauthStateKey(state string) string {
+	return "oauth:state:" + state
+}
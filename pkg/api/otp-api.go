@@ -1,66 +1,210 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
-	"time"
+	"math/big"
+	"pdserver/pkg/config"
+	"pdserver/pkg/mailer"
+	"pdserver/pkg/repository"
+	"strconv"
+	"strings"
 
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
-	gomail "gopkg.in/mail.v2"
+	"github.com/google/uuid"
 )
 
 var (
-	gmail = os.Getenv("GMAIL_USER")
-	pwd   = os.Getenv("GMAIL_PASSWORD")
+	ErrInvalidCode     = errors.New("Invalid verification code")
+	ErrCodeExpired     = errors.New("Verification code has expired")
+	ErrTooManyAttempts = errors.New("Too many wrong verification codes")
+	ErrInvalidTicket   = errors.New("Email has not been verified")
 )
 
-type OTPAPIService struct {
-	Key *otp.Key
+// OTPPurpose - What a code was mailed for, a code and its ticket only work for the same purpose
+type OTPPurpose string
+
+const (
+	OTPPurposeVerify OTPPurpose = "verify"
+	OTPPurposeReset  OTPPurpose = "reset"
+	OTPPurposeUnlock OTPPurpose = "unlock"
+)
+
+// EmailOTP - Single use verification codes mailed to an address.
+// A verified code is traded for a ticket that proves ownership of the address.
+type EmailOTP struct {
+	Storage repository.KeyValueStore
+	Sender  MailSender
+	Config  config.OTPConfig
 }
 
-func NewOTPService() *OTPAPIService {
-	key, _ := totp.Generate(totp.GenerateOpts{
-		Issuer:      "support@plantdoctor.com",
-		AccountName: "support@plantdoctor.com",
-		Period:      180,
-	})
-	return &OTPAPIService{Key: key}
+type OTPAPIService interface {
+	SendEmail(email string, locale string) error
+	SendPasswordReset(email string, locale string) error
+	SendUnlock(email string, locale string) error
+	Verify(purpose OTPPurpose, email string, code string) (string, error)
+	CheckTicket(ticket string, purpose OTPPurpose, email string) error
+	RedeemTicket(ticket string, purpose OTPPurpose, email string) error
+	ConsumeTicket(ticket string) error
 }
 
-func (o *OTPAPIService) GenerateCode() (string, error) {
-	code, err := totp.GenerateCode(o.Key.Secret(), time.Now())
+func NewOTPService(store repository.KeyValueStore, sender MailSender, cfg config.OTPConfig) *EmailOTP {
+	return &EmailOTP{Storage: store, Sender: sender, Config: cfg}
+}
+
+// GenerateCode - Random 6 digit code
+func (o *EmailOTP) GenerateCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
 	if err != nil {
 		return "", err
 	}
-	return code, nil
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// SendEmail - Mail a new sign up code to the address, replacing any previous one
+func (o *EmailOTP) SendEmail(email string, locale string) error {
+	return o.send(OTPPurposeVerify, email, mailer.TemplateSignupCode, locale)
 }
 
-func (o *OTPAPIService) SendEmail(email string) error {
-	dial := gomail.NewDialer("smtp.gmail.com", 587, gmail, pwd)
-	res, err := dial.Dial()
+// SendPasswordReset - Mail a code that lets the owner of the address set a new password
+func (o *EmailOTP) SendPasswordReset(email string, locale string) error {
+	return o.send(OTPPurposeReset, email, mailer.TemplatePasswordReset, locale)
+}
+
+// SendUnlock - Mail a code that lifts a sign in lockout of the address
+func (o *EmailOTP) SendUnlock(email string, locale string) error {
+	return o.send(OTPPurposeUnlock, email, mailer.TemplateAccountUnlock, locale)
+}
+
+func (o *EmailOTP) send(purpose OTPPurpose, email string, template string, locale string) error {
+	email = normalizeEmail(email)
+	code, err := o.GenerateCode()
 	if err != nil {
 		return err
 	}
-	code, err := o.GenerateCode()
-	msg := gomail.NewMessage()
-	msg.SetHeaders(map[string][]string{
-		"From":    {msg.FormatAddress("support@plantdoctor.com", "PlantDoctor")},
-		"To":      {email},
-		"Subject": {"PlantDoctor 회원가입 인증코드"},
+	if _, err := o.Storage.Del(otpAttemptsKey(purpose, email)); err != nil {
+		return err
+	}
+	if err := o.Storage.Set(otpCodeKey(purpose, email), hashCode(code), o.Config.CodeTTL); err != nil {
+		return err
+	}
+	return o.Sender.Send(email, template, locale, map[string]string{
+		"code":    code,
+		"minutes": strconv.Itoa(int(o.Config.CodeTTL.Minutes())),
 	})
-	msg.SetBody("text/plain", fmt.Sprintf("인증코드: %s", code))
-	if err := gomail.Send(res, msg); err != nil {
+}
+
+// Verify - Check code mailed for purpose to the address and return a verification ticket
+func (o *EmailOTP) Verify(purpose OTPPurpose, email string, code string) (string, error) {
+	email = normalizeEmail(email)
+	stored, err := o.Storage.Get(otpCodeKey(purpose, email))
+	if errors.Is(err, repository.ErrNil) {
+		return "", ErrCodeExpired
+	}
+	if err != nil {
+		return "", err
+	}
+	attempts, err := o.Storage.Incr(otpAttemptsKey(purpose, email))
+	if err != nil {
+		return "", err
+	}
+	if attempts == 1 {
+		if err := o.Storage.Expire(otpAttemptsKey(purpose, email), o.Config.CodeTTL); err != nil {
+			return "", err
+		}
+	}
+	if attempts > int64(o.Config.MaxAttempts) {
+		if _, err := o.Storage.Del(otpCodeKey(purpose, email), otpAttemptsKey(purpose, email)); err != nil {
+			return "", err
+		}
+		return "", ErrTooManyAttempts
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(hashCode(code))) != 1 {
+		return "", ErrInvalidCode
+	}
+	// Codes are single use, whoever deletes it first wins
+	deleted, err := o.Storage.Del(otpCodeKey(purpose, email))
+	if err != nil {
+		return "", err
+	}
+	if deleted == 0 {
+		return "", ErrCodeExpired
+	}
+	if _, err := o.Storage.Del(otpAttemptsKey(purpose, email)); err != nil {
+		return "", err
+	}
+	ticket := uuid.NewString()
+	if err := o.Storage.Set(otpTicketKey(ticket), ticketValue(purpose, email), o.Config.TicketTTL); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// CheckTicket - Confirm ticket was issued for the address by a code of the same purpose
+func (o *EmailOTP) CheckTicket(ticket string, purpose OTPPurpose, email string) error {
+	if ticket == "" {
+		return ErrInvalidTicket
+	}
+	verified, err := o.Storage.Get(otpTicketKey(ticket))
+	if errors.Is(err, repository.ErrNil) {
+		return ErrInvalidTicket
+	}
+	if err != nil {
 		return err
 	}
+	if verified != ticketValue(purpose, normalizeEmail(email)) {
+		return ErrInvalidTicket
+	}
 	return nil
 }
 
-func (o *OTPAPIService) Validate(code string) bool {
-	isValid := totp.Validate(code, o.Key.Secret())
-	if isValid {
-		return true
-	} else {
-		return false
+// RedeemTicket - Check ticket was issued for the address and purpose and invalidate it.
+// Only one caller can redeem a ticket, concurrent requests with the same one get ErrInvalidTicket.
+func (o *EmailOTP) RedeemTicket(ticket string, purpose OTPPurpose, email string) error {
+	if err := o.CheckTicket(ticket, purpose, email); err != nil {
+		return err
+	}
+	deleted, err := o.Storage.Del(otpTicketKey(ticket))
+	if err != nil {
+		return err
 	}
+	if deleted != 1 {
+		return ErrInvalidTicket
+	}
+	return nil
+}
+
+// ConsumeTicket - Invalidate ticket once it has been used
+func (o *EmailOTP) ConsumeTicket(ticket string) error {
+	_, err := o.Storage.Del(otpTicketKey(ticket))
+	return err
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func otpCodeKey(purpose OTPPurpose, email string) string {
+	return "otp:code:" + string(purpose) + ":" + email
+}
+
+func otpAttemptsKey(purpose OTPPurpose, email string) string {
+	return "otp:attempts:" + string(purpose) + ":" + email
+}
+
+// ticketValue - Tickets store the purpose of their code next to the address
+func ticketValue(purpose OTPPurpose, email string) string {
+	return string(purpose) + ":" + email
+}
+
+func otpTicketKey(ticket string) string {
+	return "otp:ticket:" + ticket
 }
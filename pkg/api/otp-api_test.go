@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestOTP() (*EmailOTP, *MemoryMailSender) {
+	mail := NewMemoryMailSender()
+	otp := NewOTPService(repository.NewMemoryStore(), mail,
+		config.OTPConfig{CodeTTL: time.Minute, TicketTTL: time.Minute, MaxAttempts: 3})
+	return otp, mail
+}
+
+func mailedCode(t *testing.T, mail *MemoryMailSender, email string) string {
+	t.Helper()
+	sent, ok := mail.Last(email)
+	if !ok {
+		t.Fatalf("no mail to %s", email)
+	}
+	return sent.Data["code"]
+}
+
+func TestOTPCodeIsSingleUse(t *testing.T) {
+	otp, mail := newTestOTP()
+	if err := otp.SendEmail("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	code := mailedCode(t, mail, "user@example.com")
+	if _, err := otp.Verify(OTPPurposeVerify, "other@example.com", code); !errors.Is(err, ErrCodeExpired) {
+		t.Fatalf("code of another address: %v", err)
+	}
+	ticket, err := otp.Verify(OTPPurposeVerify, "User@Example.com", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", code); !errors.Is(err, ErrCodeExpired) {
+		t.Fatalf("second use: %v", err)
+	}
+	if err := otp.CheckTicket(ticket, OTPPurposeVerify, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := otp.CheckTicket(ticket, OTPPurposeVerify, "other@example.com"); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("ticket of another address: %v", err)
+	}
+}
+
+func TestOTPAttemptLimit(t *testing.T) {
+	otp, mail := newTestOTP()
+	if err := otp.SendEmail("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	code := mailedCode(t, mail, "user@example.com")
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", wrong); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", code); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("attempt past the limit: %v", err)
+	}
+	// The code is gone, a new one starts a new count
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", code); !errors.Is(err, ErrCodeExpired) {
+		t.Fatalf("after the limit: %v", err)
+	}
+	if err := otp.SendEmail("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", mailedCode(t, mail, "user@example.com")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedeemTicketOnce(t *testing.T) {
+	otp, mail := newTestOTP()
+	if err := otp.SendEmail("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	ticket, err := otp.Verify(OTPPurposeVerify, "user@example.com", mailedCode(t, mail, "user@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if otp.RedeemTicket(ticket, OTPPurposeVerify, "user@example.com") == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if redeemed != 1 {
+		t.Fatalf("ticket redeemed %d times", redeemed)
+	}
+}
+
+func TestOTPPurposesAreSeparate(t *testing.T) {
+	otp, mail := newTestOTP()
+	if err := otp.SendPasswordReset("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	reset := mailedCode(t, mail, "user@example.com")
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", reset); !errors.Is(err, ErrCodeExpired) {
+		t.Fatalf("reset code as a sign up code: %v", err)
+	}
+	if err := otp.SendEmail("user@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	signup := mailedCode(t, mail, "user@example.com")
+	// Mailing a code for one purpose leaves the other one valid
+	ticket, err := otp.Verify(OTPPurposeReset, "user@example.com", reset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := otp.CheckTicket(ticket, OTPPurposeVerify, "user@example.com"); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("reset ticket as a verification ticket: %v", err)
+	}
+	if _, err := otp.Verify(OTPPurposeUnlock, "user@example.com", signup); !errors.Is(err, ErrCodeExpired) {
+		t.Fatalf("sign up code as an unlock code: %v", err)
+	}
+	if _, err := otp.Verify(OTPPurposeVerify, "user@example.com", signup); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"pdserver/pkg/config"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher - Hash and verify local account passwords with bcrypt
+type PasswordHasher struct {
+	Cost int
+
+	dummyOnce sync.Once
+	dummy     []byte
+}
+
+// NewPasswordHasher - Create password hasher with configured bcrypt cost
+func NewPasswordHasher(cfg config.PasswordConfig) *PasswordHasher {
+	return &PasswordHasher{Cost: cfg.Cost}
+}
+
+// Hash - Hash password, bcrypt generates a random salt per call
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Compare - Check password against stored hash
+func (h *PasswordHasher) Compare(hash string, password string) (bool, error) {
+	if hash == "" {
+		h.CompareDummy(password)
+		return false, nil
+	}
+	if !isBcryptHash(hash) {
+		// Rows created before hashing was introduced hold the raw password
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareDummy - Spend as long as Compare on a real hash, for sign ins of unknown accounts.
+// Without it the response time tells which emails are registered.
+func (h *PasswordHasher) CompareDummy(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), h.Cost)
+	})
+	bcrypt.CompareHashAndPassword(h.dummy, []byte(password))
+}
+
+// NeedsRehash - Report whether hash was made with other parameters than current ones
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != h.Cost
+}
+
+func isBcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
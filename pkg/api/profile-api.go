@@ -0,0 +1,45 @@
+package api
+
+import (
+	"pdserver/pkg/api/model"
+)
+
+// UpdateProfile - Apply the fields that are set and return the updated user
+func (db *UserDB) UpdateProfile(userID uint64, update *model.ProfileUpdate) (*model.User, error) {
+	fields := map[string]interface{}{}
+	if update.Name != nil {
+		fields["name"] = *update.Name
+	}
+	if update.Nickname != nil {
+		fields["nickname"] = *update.Nickname
+	}
+	if update.Birth != nil {
+		fields["birth"] = *update.Birth
+	}
+	if len(fields) > 0 {
+		if res := db.Storage.Model(&model.User{ID: userID}).Updates(fields); res.Error != nil {
+			return nil, res.Error
+		}
+	}
+	return db.GetWithID(userID)
+}
+
+// ChangeEmail - Switch the address, the caller verifies it first
+func (db *UserDB) ChangeEmail(userID uint64, email string) error {
+	if res := db.Storage.Model(&model.User{ID: userID}).Update("email", email); res.Error != nil {
+		return res.Error
+	}
+	return nil
+}
+
+// SetPassword - Hash and store a new password
+func (db *UserDB) SetPassword(userID uint64, password string) error {
+	hash, err := db.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	if res := db.Storage.Model(&model.User{ID: userID}).Update("password", hash); res.Error != nil {
+		return res.Error
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"time"
+)
+
+// Routes with their own rate limit policy
+const (
+	RateLimitLogin    = "login"
+	RateLimitMail     = "mail"
+	RateLimitCode     = "code"
+	RateLimitNickname = "nickname"
+	RateLimitRegister = "register"
+	RateLimitExchange = "exchange"
+	RateLimitRefresh  = "refresh"
+)
+
+// What a request is counted by
+const (
+	RateLimitByIP      = "ip"
+	RateLimitByEmail   = "email"
+	RateLimitByAccount = "account"
+)
+
+// RateLimit - Outcome of counting one request
+type RateLimit struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset - Until the current window ends
+	Reset time.Duration
+	// RetryAfter - Until a request would be allowed again, zero when allowed
+	RetryAfter time.Duration
+}
+
+// RateLimiter - Sliding window counters in the key value store.
+// The count of the previous fixed window is weighted by how much of it still overlaps the sliding window,
+// so only two counters are kept per key. Rejected requests are counted too, clients that keep
+// hammering stay limited, except by email: anyone can send the email of someone else,
+// and counting those would keep its owner out for as long as they do. With a MemoryStore it runs without redis.
+type RateLimiter struct {
+	Storage repository.KeyValueStore
+	Config  config.RateLimitConfig
+}
+
+type RateLimitAPIService interface {
+	Allow(route string, by string, key string) (*RateLimit, error)
+}
+
+func NewRateLimiter(store repository.KeyValueStore, cfg config.RateLimitConfig) *RateLimiter {
+	return &RateLimiter{Storage: store, Config: cfg}
+}
+
+// Allow - Count a request to route from key, nil when the policy does not limit by this kind of key
+func (l *RateLimiter) Allow(route string, by string, key string) (*RateLimit, error) {
+	if !l.Config.Enabled || key == "" {
+		return nil, nil
+	}
+	policy, ok := l.policy(route)
+	if !ok {
+		return nil, nil
+	}
+	limit := policyLimit(policy, by)
+	if limit == 0 {
+		return nil, nil
+	}
+	window := policy.Window
+	now := time.Now()
+	current := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() % int64(window))
+	prefix := "ratelimit:" + route + ":" + by + ":" + key + ":"
+
+	count, err := l.Storage.Incr(prefix + strconv.FormatInt(current, 10))
+	if err != nil {
+		return nil, err
+	}
+	if count == 1 {
+		// Still needed as the previous window of the next one
+		if err := l.Storage.Expire(prefix+strconv.FormatInt(current, 10), 2*window); err != nil {
+			return nil, err
+		}
+	}
+	previous, err := l.count(prefix + strconv.FormatInt(current-1, 10))
+	if err != nil {
+		return nil, err
+	}
+	weight := 1 - float64(elapsed)/float64(window)
+	used := int(math.Floor(float64(previous)*weight)) + int(count)
+	result := &RateLimit{Allowed: used <= limit, Limit: limit, Remaining: limit - used, Reset: window - elapsed}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	if !result.Allowed {
+		result.RetryAfter = retryAfter(limit, previous, count, elapsed, window)
+		if by == RateLimitByEmail {
+			if _, err := l.Storage.Decr(prefix + strconv.FormatInt(current, 10)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// retryAfter - Time until the weighted count drops below limit, assuming no more requests
+func retryAfter(limit int, previous int64, current int64, elapsed time.Duration, window time.Duration) time.Duration {
+	free := float64(limit - 1)
+	if float64(current) <= free && previous > 0 {
+		// The previous window fades out before the current one ends
+		return time.Duration((1-(free-float64(current))/float64(previous))*float64(window)) - elapsed
+	}
+	// Wait for the current window to end and then to fade out enough
+	return window - elapsed + time.Duration((1-free/float64(current))*float64(window))
+}
+
+func (l *RateLimiter) count(key string) (int64, error) {
+	val, err := l.Storage.Get(key)
+	if errors.Is(err, repository.ErrNil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+func (l *RateLimiter) policy(route string) (config.RateLimitPolicy, bool) {
+	switch route {
+	case RateLimitLogin:
+		return l.Config.Login, true
+	case RateLimitMail:
+		return l.Config.Mail, true
+	case RateLimitCode:
+		return l.Config.Code, true
+	case RateLimitNickname:
+		return l.Config.Nickname, true
+	case RateLimitRegister:
+		return l.Config.Register, true
+	case RateLimitExchange:
+		return l.Config.Exchange, true
+	case RateLimitRefresh:
+		return l.Config.Refresh, true
+	}
+	return config.RateLimitPolicy{}, false
+}
+
+func policyLimit(policy config.RateLimitPolicy, by string) int {
+	switch by {
+	case RateLimitByIP:
+		return policy.PerIP
+	case RateLimitByEmail:
+		return policy.PerEmail
+	case RateLimitByAccount:
+		return policy.PerAccount
+	}
+	return 0
+}
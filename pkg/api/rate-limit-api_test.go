@@ -0,0 +1,84 @@
+package api
+
+import (
+	"math"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testWindow = 24 * time.Hour
+
+func newTestRateLimiter(perIP int) (*RateLimiter, *repository.MemoryStore) {
+	store := repository.NewMemoryStore()
+	return NewRateLimiter(store, config.RateLimitConfig{Enabled: true,
+		Login: config.RateLimitPolicy{Window: testWindow, PerIP: perIP}}), store
+}
+
+func TestRateLimitWithinWindow(t *testing.T) {
+	limiter, _ := newTestRateLimiter(3)
+	for i := 1; i <= 3; i++ {
+		limit, err := limiter.Allow(RateLimitLogin, RateLimitByIP, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limit.Allowed || limit.Remaining != 3-i {
+			t.Fatalf("request %d: %+v", i, limit)
+		}
+	}
+	limit, err := limiter.Allow(RateLimitLogin, RateLimitByIP, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.Allowed || limit.RetryAfter <= 0 || limit.RetryAfter > 2*testWindow {
+		t.Fatalf("request past the limit: %+v", limit)
+	}
+	// Keys and kinds of keys are counted apart
+	if limit, _ := limiter.Allow(RateLimitLogin, RateLimitByIP, "192.0.2.2"); !limit.Allowed {
+		t.Fatalf("other IP: %+v", limit)
+	}
+	if limit, _ := limiter.Allow(RateLimitLogin, RateLimitByEmail, "user@example.com"); limit != nil {
+		t.Fatalf("policy without an email limit: %+v", limit)
+	}
+	if limit, _ := limiter.Allow(RateLimitRefresh, RateLimitByIP, "192.0.2.1"); limit != nil {
+		t.Fatalf("route without a policy: %+v", limit)
+	}
+}
+
+func TestRateLimitWeighsPreviousWindow(t *testing.T) {
+	limiter, store := newTestRateLimiter(100)
+	now := time.Now()
+	previous := now.UnixNano()/int64(testWindow) - 1
+	if err := store.Set("ratelimit:login:ip:192.0.2.1:"+strconv.FormatInt(previous, 10), "80", 2*testWindow); err != nil {
+		t.Fatal(err)
+	}
+	limit, err := limiter.Allow(RateLimitLogin, RateLimitByIP, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight := 1 - float64(now.UnixNano()%int64(testWindow))/float64(testWindow)
+	used := int(math.Floor(80*weight)) + 1
+	// The window may have moved on by a request's worth of time
+	if limit.Remaining != 100-used && limit.Remaining != 100-used+1 {
+		t.Fatalf("remaining %d, want %d", limit.Remaining, 100-used)
+	}
+}
+
+func TestRateLimitByEmailCountsAllowedOnly(t *testing.T) {
+	store := repository.NewMemoryStore()
+	limiter := NewRateLimiter(store, config.RateLimitConfig{Enabled: true,
+		Login: config.RateLimitPolicy{Window: testWindow, PerIP: 2, PerEmail: 2}})
+	for i := 0; i < 5; i++ {
+		limiter.Allow(RateLimitLogin, RateLimitByEmail, "user@example.com")
+		limiter.Allow(RateLimitLogin, RateLimitByIP, "192.0.2.1")
+	}
+	current := strconv.FormatInt(time.Now().UnixNano()/int64(testWindow), 10)
+	if count, _ := store.Get("ratelimit:login:email:user@example.com:" + current); count != "2" {
+		t.Fatalf("email counted %s times", count)
+	}
+	if count, _ := store.Get("ratelimit:login:ip:192.0.2.1:" + current); count != "5" {
+		t.Fatalf("IP counted %s times", count)
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/repository"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Last seen time is only written back when it is older than this
+const sessionTouchInterval = time.Minute
+
+// A device not used to sign in for this long is reported as new again
+const knownDeviceTTL = 180 * 24 * time.Hour
+
+var ErrSessionNotFound = errors.New("Session not found")
+
+// saveSession - Create the session of a new family or extend the existing one
+func (db *TokenDB) saveSession(tmd *model.TokenMetaData) error {
+	now := time.Now()
+	session, err := db.getSession(tmd.FamilyID)
+	if errors.Is(err, ErrSessionNotFound) {
+		session = &model.Session{ID: tmd.FamilyID, DeviceInfo: tmd.Device, UserID: tmd.UserID, CreatedAt: now}
+	} else if err != nil {
+		return err
+	}
+	session.LastSeenAt = now
+	session.ExpiresAt = time.Unix(tmd.RtExpire, 0)
+	if err := db.putSession(session); err != nil {
+		return err
+	}
+	indexKey := userSessionsKey(tmd.UserID)
+	if err := db.Storage.SAdd(indexKey, session.ID); err != nil {
+		return err
+	}
+	// The index lives as long as the newest session in it
+	return db.Storage.Expire(indexKey, session.ExpiresAt.Sub(now))
+}
+
+// TouchSession - Record that the session has just been used
+func (db *TokenDB) TouchSession(sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	session, err := db.getSession(sessionID)
+	if err != nil {
+		return err
+	}
+	if time.Since(session.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	session.LastSeenAt = time.Now()
+	return db.putSession(session)
+}
+
+// ListSessions - Live sessions of the user, most recently used first
+func (db *TokenDB) ListSessions(userID uint64) ([]model.Session, error) {
+	ids, err := db.Storage.SMembers(userSessionsKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []model.Session{}
+	for _, id := range ids {
+		session, err := db.getSession(id)
+		if errors.Is(err, ErrSessionNotFound) {
+			if err := db.Storage.SRem(userSessionsKey(userID), id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// RememberDevice - Record a sign in from device, true when the user signed in before
+// but never from this device. A user's first device is not reported as new.
+func (db *TokenDB) RememberDevice(userID uint64, device model.DeviceInfo) (bool, error) {
+	key := knownDevicesKey(userID)
+	known, err := db.Storage.SMembers(key)
+	if err != nil {
+		return false, err
+	}
+	fingerprint := deviceFingerprint(device)
+	isNew := len(known) > 0
+	for _, member := range known {
+		if member == fingerprint {
+			isNew = false
+		}
+	}
+	if err := db.Storage.SAdd(key, fingerprint); err != nil {
+		return false, err
+	}
+	return isNew, db.Storage.Expire(key, knownDeviceTTL)
+}
+
+// RevokeSession - Log out one session of the user
+func (db *TokenDB) RevokeSession(userID uint64, sessionID string) error {
+	session, err := db.getSession(sessionID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return ErrSessionNotFound
+	}
+	current, err := db.Storage.Get(familyKey(sessionID))
+	if errors.Is(err, repository.ErrNil) {
+		return db.deleteSession(userID, sessionID)
+	}
+	if err != nil {
+		return err
+	}
+	return db.revokeFamily(userID, sessionID, current)
+}
+
+// RevokeAllSessions - Log out every session of the user but exceptID, which may be empty
+func (db *TokenDB) RevokeAllSessions(userID uint64, exceptID string) error {
+	sessions, err := db.ListSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == exceptID {
+			continue
+		}
+		if err := db.RevokeSession(userID, session.ID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *TokenDB) getSession(sessionID string) (*model.Session, error) {
+	data, err := db.Storage.Get(sessionKey(sessionID))
+	if errors.Is(err, repository.ErrNil) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored storedSession
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	session := stored.Session
+	session.UserID = stored.UserID
+	return &session, nil
+}
+
+func (db *TokenDB) putSession(session *model.Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return db.deleteSession(session.UserID, session.ID)
+	}
+	data, err := json.Marshal(storedSession{Session: *session, UserID: session.UserID})
+	if err != nil {
+		return err
+	}
+	return db.Storage.Set(sessionKey(session.ID), string(data), ttl)
+}
+
+func (db *TokenDB) deleteSession(userID uint64, sessionID string) error {
+	if _, err := db.Storage.Del(sessionKey(sessionID)); err != nil {
+		return err
+	}
+	return db.Storage.SRem(userSessionsKey(userID), sessionID)
+}
+
+// storedSession - Session as kept in redis, user id is hidden from API responses
+type storedSession struct {
+	model.Session
+	UserID uint64 `json:"user_id"`
+}
+
+// deviceFingerprint - Devices are told apart by name and user agent, the IP changes too often
+func deviceFingerprint(device model.DeviceInfo) string {
+	sum := sha256.Sum256([]byte(device.DeviceName + "\n" + device.UserAgent))
+	return hex.EncodeToString(sum[:8])
+}
+
+func sessionKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+func userSessionsKey(userID uint64) string {
+	return "user_sessions:" + strconv.FormatUint(userID, 10)
+}
+
+func knownDevicesKey(userID uint64) string {
+	return "known_devices:" + strconv.FormatUint(userID, 10)
+}
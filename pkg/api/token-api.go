@@ -1,48 +1,111 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/repository"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 )
 
+// TokenDB - Access and refresh tokens stored in redis.
+// Every login starts a token family; refreshing rotates the pair inside the family,
+// and replaying an already rotated refresh token revokes the whole family.
+// Tokens are signed with RS256 keys from KeyRing; the secrets only verify HS256 tokens issued before.
 type TokenDB struct {
-	Storage *redis.Client
+	Storage       repository.KeyValueStore
+	KeyRing       *KeyRing
+	Audit         Auditor
+	Roles         RoleLoader
+	Config        config.JWTConfig
+	AccessSecret  []byte
+	RefreshSecret []byte
+}
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+var (
+	ErrTokenExpired          = errors.New("Access token has expired")
+	ErrTokenRevoked          = errors.New("Access token has been revoked")
+	ErrTokenMalformed        = errors.New("Access token is malformed")
+	ErrRefreshTokenRevoked   = errors.New("Refresh token has been revoked")
+	ErrRefreshTokenMalformed = errors.New("Refresh token is malformed")
+	ErrRefreshTokenReused    = errors.New("Refresh token has already been used")
+)
+
+// RoleLoader - Current roles of a user, refreshed tokens carry them instead of the old ones
+type RoleLoader interface {
+	GetRoles(userID uint64) ([]string, error)
 }
 
 type TokenAPIService interface {
-	Create(id uint64) (*model.TokenMetaData, error)
+	Create(id uint64, roles []string, device model.DeviceInfo) (*model.TokenMetaData, error)
 	Post(tmd *model.TokenMetaData) (*model.Token, error)
 	RePost(refreshToken string) (*model.Token, error)
-	Validate(token string) error
-	FetchUserID(accessToken string) (*model.TokenMetaData, error)
+	Validate(token string) (*model.TokenMetaData, error)
+	GetTokenMetaData(accessToken string) (*model.TokenMetaData, error)
 	Delete(tmd *model.TokenMetaData) error
+	TouchSession(sessionID string) error
+	ListSessions(userID uint64) ([]model.Session, error)
+	RevokeSession(userID uint64, sessionID string) error
+	RevokeAllSessions(userID uint64, exceptID string) error
+	RememberDevice(userID uint64, device model.DeviceInfo) (bool, error)
+	JWKS() model.JWKS
+}
+
+// NewTokenDB - Create token db on top of redis or in-memory store
+func NewTokenDB(store repository.KeyValueStore, keyRing *KeyRing, cfg config.JWTConfig, auditor Auditor, roles RoleLoader) *TokenDB {
+	return &TokenDB{Storage: store, KeyRing: keyRing, Audit: auditor, Roles: roles, Config: cfg,
+		AccessSecret: []byte(cfg.AccessSecret), RefreshSecret: []byte(cfg.RefreshSecret)}
 }
 
-// NewTokenDB - Create redis db
-func NewTokenDB(redisDB *redis.Client) *TokenDB {
-	return &TokenDB{Storage: redisDB}
+// Create - Create token meta data for a new login, starting a new token family.
+// The family id doubles as the id of the session listed to the user.
+// Roles and their permissions are embedded in the access token and loaded again when refreshing.
+func (db *TokenDB) Create(id uint64, roles []string, device model.DeviceInfo) (*model.TokenMetaData, error) {
+	tmd, err := db.create(id, uuid.NewString(), roles)
+	if err != nil {
+		return nil, err
+	}
+	tmd.Device = device
+	return tmd, nil
 }
 
-// Create - Create token meta data
-func (db *TokenDB) Create(id uint64) (*model.TokenMetaData, error) {
-	atExpire := time.Now().Add(time.Hour * 1).Unix()
-	rtExpire := time.Now().Add(time.Hour * 24).Unix()
+func (db *TokenDB) create(id uint64, familyID string, roles []string) (*model.TokenMetaData, error) {
+	if roles == nil {
+		roles = []string{}
+	}
+	permissions := model.PermissionsOf(roles)
+	atExpire := time.Now().Add(db.Config.AccessTTL).Unix()
+	rtExpire := time.Now().Add(db.Config.RefreshTTL).Unix()
 	accessUUID := uuid.NewString()
-	refreshUUID := accessUUID + "++" + strconv.Itoa(int(id))
+	refreshUUID := refreshUUIDOf(accessUUID, id)
+	kid, signingKey, err := db.KeyRing.Signer()
+	if err != nil {
+		return nil, err
+	}
 
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
 	atClaims["exp"] = atExpire
 	atClaims["access_uuid"] = accessUUID
+	atClaims["family_id"] = familyID
+	atClaims["token_type"] = accessTokenType
 	atClaims["user_id"] = id
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	accessToken, err := at.SignedString([]byte(model.ACCESS_SECRET))
+	atClaims["roles"] = roles
+	atClaims["permissions"] = permissions
+	at := jwt.NewWithClaims(jwt.SigningMethodRS256, atClaims)
+	at.Header["kid"] = kid
+	accessToken, err := at.SignedString(signingKey)
 	if err != nil {
 		return nil, err
 	}
@@ -50,14 +113,17 @@ func (db *TokenDB) Create(id uint64) (*model.TokenMetaData, error) {
 	rtClaims["authorized"] = true
 	rtClaims["exp"] = rtExpire
 	rtClaims["refresh_uuid"] = refreshUUID
+	rtClaims["family_id"] = familyID
+	rtClaims["token_type"] = refreshTokenType
 	rtClaims["user_id"] = id
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	refreshToken, err := rt.SignedString([]byte(model.REFRESH_SECRET))
+	rt := jwt.NewWithClaims(jwt.SigningMethodRS256, rtClaims)
+	rt.Header["kid"] = kid
+	refreshToken, err := rt.SignedString(signingKey)
 	if err != nil {
 		return nil, err
 	}
 	return &model.TokenMetaData{AccessToken: accessToken, RefreshToken: refreshToken, AccessUUID: accessUUID, RefreshUUID: refreshUUID,
-		AtExpire: atExpire, RtExpire: rtExpire, UserID: id}, nil
+		AtExpire: atExpire, RtExpire: rtExpire, FamilyID: familyID, UserID: id, Roles: roles, Permissions: permissions}, nil
 }
 
 // Post - Save token information to db
@@ -65,38 +131,74 @@ func (db *TokenDB) Post(tmd *model.TokenMetaData) (*model.Token, error) {
 	atExpire := time.Unix(tmd.AtExpire, 0)
 	rtExpire := time.Unix(tmd.RtExpire, 0)
 	now := time.Now()
-	if res := db.Storage.Set(tmd.AccessUUID, strconv.Itoa(int(tmd.UserID)), atExpire.Sub(now)); res.Err() != nil {
-		return nil, res.Err()
+	if err := db.Storage.Set(tmd.AccessUUID, strconv.Itoa(int(tmd.UserID)), atExpire.Sub(now)); err != nil {
+		return nil, err
 	}
-	if res := db.Storage.Set(tmd.RefreshUUID, strconv.Itoa(int(tmd.UserID)), rtExpire.Sub(now)); res.Err() != nil {
-		return nil, res.Err()
+	if err := db.Storage.Set(tmd.RefreshUUID, strconv.Itoa(int(tmd.UserID)), rtExpire.Sub(now)); err != nil {
+		return nil, err
+	}
+	// The family remembers which refresh token is the current one
+	if err := db.Storage.Set(familyKey(tmd.FamilyID), tmd.RefreshUUID, rtExpire.Sub(now)); err != nil {
+		return nil, err
+	}
+	if err := db.saveSession(tmd); err != nil {
+		return nil, err
 	}
 	return &model.Token{AccessToken: tmd.AccessToken, RefreshToken: tmd.RefreshToken}, nil
 }
 
-// Repost - Update token information
+// Repost - Rotate refresh token, revoking its family when it was already rotated
 func (db *TokenDB) RePost(refreshToken string) (*model.Token, error) {
-	token, err := jwt.Parse(refreshToken, RefreshKeyFunc)
+	token, err := jwt.Parse(refreshToken, db.RefreshKeyFunc)
 	if err != nil {
 		return nil, err
 	}
 	if _, ok := token.Claims.(jwt.Claims); !ok || !token.Valid {
-		return nil, fmt.Errorf("Invalid token")
+		return nil, ErrRefreshTokenMalformed
 	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		refreshUUID, ok := claims["refresh_uuid"].(string)
 		if !ok {
-			return nil, fmt.Errorf("Something went wrong")
+			return nil, ErrRefreshTokenMalformed
 		}
 		userID, err := strconv.ParseUint(fmt.Sprintf("%.f", claims["user_id"]), 10, 64)
+		if err != nil {
+			return nil, ErrRefreshTokenMalformed
+		}
+		familyID, _ := claims["family_id"].(string)
+		if familyID == "" {
+			// Issued before token families existed, start one now
+			familyID = uuid.NewString()
+		} else {
+			current, err := db.Storage.Get(familyKey(familyID))
+			if errors.Is(err, repository.ErrNil) {
+				return nil, ErrRefreshTokenRevoked
+			}
+			if err != nil {
+				return nil, err
+			}
+			if current != refreshUUID {
+				if err := db.revokeFamily(userID, familyID, current); err != nil {
+					return nil, err
+				}
+				db.Audit.Emit(AuditEvent{Type: AuditRefreshTokenReuse, UserID: userID, Time: time.Now(),
+					Detail: map[string]string{"family_id": familyID, "refresh_uuid": refreshUUID}})
+				return nil, ErrRefreshTokenReused
+			}
+		}
+		res, err := db.Storage.Del(refreshUUID, accessUUIDOf(refreshUUID))
 		if err != nil {
 			return nil, err
 		}
-		res, err := DeleteAToken(db.Storage, refreshUUID)
-		if err != nil || res == 0 {
+		if res == 0 {
+			return nil, ErrRefreshTokenRevoked
+		}
+		// Roles may have changed since the session started
+		roles, err := db.Roles.GetRoles(userID)
+		if err != nil {
 			return nil, err
 		}
-		newTmd, err := db.Create(userID)
+		newTmd, err := db.create(userID, familyID, roles)
 		if err != nil {
 			return nil, err
 		}
@@ -106,45 +208,54 @@ func (db *TokenDB) RePost(refreshToken string) (*model.Token, error) {
 		}
 		return newToken, nil
 	} else {
-		return nil, fmt.Errorf("Refresh token has expired")
+		return nil, ErrRefreshTokenMalformed
 	}
 }
 
-// Validate - Verify the token is valid
-func (db *TokenDB) Validate(accessToken string) error {
-	jwtToken, err := jwt.Parse(accessToken, AccessKeyFunc)
+// Validate - Verify the token is valid and its session still exists
+func (db *TokenDB) Validate(accessToken string) (*model.TokenMetaData, error) {
+	tmd, err := db.GetTokenMetaData(accessToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if _, ok := jwtToken.Claims.(jwt.Claims); !ok || !jwtToken.Valid {
-		return fmt.Errorf("Invalid token")
+	stored, err := db.Storage.Get(tmd.AccessUUID)
+	if errors.Is(err, repository.ErrNil) {
+		return nil, ErrTokenRevoked
 	}
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	if stored != strconv.FormatUint(tmd.UserID, 10) {
+		return nil, ErrTokenRevoked
+	}
+	return tmd, nil
 }
 
-// FetchUserID - Fetch User ID from access token
+// GetTokenMetaData - Read claims of access token without checking its session
 func (db *TokenDB) GetTokenMetaData(accessToken string) (*model.TokenMetaData, error) {
-	jwtToken, err := jwt.Parse(accessToken, AccessKeyFunc)
+	jwtToken, err := jwt.Parse(accessToken, db.AccessKeyFunc)
 	if err != nil {
-		return nil, err
+		var vErr *jwt.ValidationError
+		if errors.As(err, &vErr) && vErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrTokenMalformed
 	}
 	claims, ok := jwtToken.Claims.(jwt.MapClaims)
 	if ok && jwtToken.Valid {
 		accessUUID, ok := claims["access_uuid"].(string)
 		if !ok {
-			return nil, fmt.Errorf("Something went wrong in access uuid")
-		}
-		refreshUUID, ok := claims["refresh_uuid"].(string)
-		if !ok {
-			return nil, fmt.Errorf("Something went wrong in refresh uuid")
+			return nil, ErrTokenMalformed
 		}
 		userID, err := strconv.ParseUint(fmt.Sprintf("%.f", claims["user_id"]), 10, 64)
 		if err != nil {
-			return nil, err
+			return nil, ErrTokenMalformed
 		}
-		return &model.TokenMetaData{AccessUUID: accessUUID, RefreshUUID: refreshUUID, UserID: userID}, nil
+		familyID, _ := claims["family_id"].(string)
+		return &model.TokenMetaData{AccessUUID: accessUUID, RefreshUUID: refreshUUIDOf(accessUUID, userID), FamilyID: familyID, UserID: userID,
+			Roles: claimStrings(claims, "roles"), Permissions: claimStrings(claims, "permissions")}, nil
 	}
-	return nil, fmt.Errorf("Something went wrong in jwt token claims")
+	return nil, ErrTokenMalformed
 }
 
 // Delete - Delete tokens
@@ -160,27 +271,89 @@ func (db *TokenDB) Delete(tmd *model.TokenMetaData) error {
 	if atRes != 1 || rtRes != 1 {
 		return fmt.Errorf("Something went wrong")
 	}
+	if tmd.FamilyID != "" {
+		if _, err := db.Storage.Del(familyKey(tmd.FamilyID)); err != nil {
+			return err
+		}
+		if err := db.deleteSession(tmd.UserID, tmd.FamilyID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func AccessKeyFunc(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// revokeFamily - Delete the live token pair of the family, the family and its session
+func (db *TokenDB) revokeFamily(userID uint64, familyID string, currentRefreshUUID string) error {
+	if _, err := db.Storage.Del(familyKey(familyID), currentRefreshUUID, accessUUIDOf(currentRefreshUUID)); err != nil {
+		return err
 	}
-	return []byte(model.ACCESS_SECRET), nil
+	return db.deleteSession(userID, familyID)
+}
+
+// JWKS - Public keys other services verify our tokens with
+func (db *TokenDB) JWKS() model.JWKS {
+	return db.KeyRing.JWKS()
+}
+
+func (db *TokenDB) AccessKeyFunc(token *jwt.Token) (interface{}, error) {
+	return db.keyFunc(token, accessTokenType, db.AccessSecret)
 }
 
-func RefreshKeyFunc(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+func (db *TokenDB) RefreshKeyFunc(token *jwt.Token) (interface{}, error) {
+	return db.keyFunc(token, refreshTokenType, db.RefreshSecret)
+}
+
+// keyFunc - Resolve verification key by kid, tokens without kid are legacy HS256 ones
+func (db *TokenDB) keyFunc(token *jwt.Token, tokenType string, legacySecret []byte) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return legacySecret, nil
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
-	return []byte(model.REFRESH_SECRET), nil
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["token_type"] != tokenType {
+		return nil, fmt.Errorf("Expected %s token", tokenType)
+	}
+	return db.KeyRing.PublicKey(kid)
+}
+
+// refreshUUIDOf - Refresh uuid is derived from the access uuid it was issued with
+func refreshUUIDOf(accessUUID string, userID uint64) string {
+	return accessUUID + "++" + strconv.FormatUint(userID, 10)
+}
+
+// accessUUIDOf - Access uuid the refresh uuid was issued with
+func accessUUIDOf(refreshUUID string) string {
+	if i := strings.LastIndex(refreshUUID, "++"); i >= 0 {
+		return refreshUUID[:i]
+	}
+	return refreshUUID
+}
+
+func familyKey(familyID string) string {
+	return "family:" + familyID
 }
 
-func DeleteAToken(storage *redis.Client, tokenUUID string) (uint64, error) {
-	deleted, err := storage.Del(tokenUUID).Result()
+func DeleteAToken(storage repository.KeyValueStore, tokenUUID string) (uint64, error) {
+	deleted, err := storage.Del(tokenUUID)
 	if err != nil {
 		return 0, err
 	}
 	return uint64(deleted), nil
 }
+
+// claimStrings - String list claim, empty when missing as in tokens issued before roles existed
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	values := []string{}
+	list, _ := claims[name].([]interface{})
+	for _, v := range list {
+		if str, ok := v.(string); ok {
+			values = append(values, str)
+		}
+	}
+	return values
+}
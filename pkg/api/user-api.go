@@ -3,32 +3,65 @@ package api
 import (
 	"errors"
 	"fmt"
+	"log"
 	"pdserver/pkg/api/model"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
 type UserDB struct {
 	Storage *gorm.DB
+	Hasher  *PasswordHasher
 }
 
+var ErrInvalidCredentials = errors.New("Invalid email or password")
+
 type UserAPIService interface {
-	Post(model.User) error
+	Post(*model.User) error
 	GetWithID(uint64) (*model.User, error)
-	Get(*model.User) (model.User, error)
+	Get(*model.User) (*model.User, error)
+	Authenticate(string, string) (*model.User, error)
 	Delete(uint64) error
 	Available(string, string) (bool, error)
+	GetByIdentity(string, string) (*model.User, error)
+	LinkIdentity(*model.Identity) error
+	UnlinkIdentity(uint64, string) error
+	ListIdentities(uint64) ([]model.Identity, error)
+	Restore(uint64) error
+	Purge(time.Time) ([]uint64, error)
+	UpdateProfile(uint64, *model.ProfileUpdate) (*model.User, error)
+	ChangeEmail(uint64, string) error
+	SetPassword(uint64, string) error
+	ListUsers(string, int, int) ([]model.User, int, error)
+	GetRoles(uint64) ([]string, error)
+	SetRoles(uint64, []string) error
+	Suspend(uint64) error
+	Unsuspend(uint64) error
+	GetTOTP(uint64) (*model.TOTPCredential, error)
+	SaveTOTP(*model.TOTPCredential) error
+	DeleteTOTP(uint64) error
+	SetRecoveryCodes(uint64, []string) error
+	UseRecoveryCode(uint64, string) (bool, error)
+	CountRecoveryCodes(uint64) (int, error)
 }
 
 // Create user database
-func NewUserDB(db *gorm.DB) *UserDB {
-	return &UserDB{Storage: db}
+func NewUserDB(db *gorm.DB, hasher *PasswordHasher) *UserDB {
+	return &UserDB{Storage: db, Hasher: hasher}
 }
 
-// PostUser - Post user to database
+// PostUser - Post user to database, password is hashed before it is stored
 func (db *UserDB) Post(user *model.User) error {
+	if user.Password != "" {
+		hash, err := db.Hasher.Hash(user.Password)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
 	if res := db.Storage.Save(&user); res.Error != nil {
-		fmt.Println(res.Error.Error())
+		log.Println(res.Error.Error())
 		return res.Error
 	}
 	return nil
@@ -36,7 +69,6 @@ func (db *UserDB) Post(user *model.User) error {
 
 func (db *UserDB) GetWithID(userID uint64) (*model.User, error) {
 	var user model.User
-	fmt.Println(userID)
 	if res := db.Storage.First(&user, userID); res.Error != nil {
 		return nil, res.Error
 	}
@@ -46,14 +78,60 @@ func (db *UserDB) GetWithID(userID uint64) (*model.User, error) {
 // GetUser - Get user from database
 func (db *UserDB) Get(user *model.User) (*model.User, error) {
 	if res := db.Storage.
-		Where(&model.User{Email: user.Email, Password: user.Password, Name: user.Name, Nickname: user.Nickname, Birth: user.Birth}).
+		Where(&model.User{Email: user.Email, Name: user.Name, Nickname: user.Nickname, Birth: user.Birth}).
 		First(&user); res.Error != nil {
 		return nil, res.Error
 	}
 	return user, nil
 }
 
-// DeleteUser - Delete user from database
+// Authenticate - Find local user by email and verify password.
+// A deleted user is returned together with ErrAccountDeleted so it can be restored,
+// a suspended one with ErrAccountSuspended.
+func (db *UserDB) Authenticate(email string, password string) (*model.User, error) {
+	var user model.User
+	res := db.Storage.Unscoped().Where("email = ?", email).First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		db.Hasher.CompareDummy(password)
+		return nil, ErrInvalidCredentials
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	ok, err := db.Hasher.Compare(user.Password, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if user.DeletedAt != nil {
+		return &user, ErrAccountDeleted
+	}
+	if user.SuspendedAt != nil {
+		return &user, ErrAccountSuspended
+	}
+	if db.Hasher.NeedsRehash(user.Password) {
+		if err := db.rehash(&user, password); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return &user, nil
+}
+
+func (db *UserDB) rehash(user *model.User, password string) error {
+	hash, err := db.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	if res := db.Storage.Model(user).Update("password", hash); res.Error != nil {
+		return res.Error
+	}
+	user.Password = hash
+	return nil
+}
+
+// DeleteUser - Mark user deleted, the row is kept until Purge
 func (db *UserDB) Delete(id uint64) error {
 	var user model.User
 	if res := db.Storage.Delete(&user, id); res.Error != nil {
@@ -62,10 +140,11 @@ func (db *UserDB) Delete(id uint64) error {
 	return nil
 }
 
-// GetAvailable - Configure val which type is key can be used
+// GetAvailable - Configure val which type is key can be used.
+// Deleted users keep their email and nickname until they are purged.
 func (db *UserDB) Available(val string, key string) (bool, error) {
 	query := fmt.Sprintf("%s = ?", key)
-	res := db.Storage.Where(query, val).Find(&model.User{})
+	res := db.Storage.Unscoped().Where(query, val).Find(&model.User{})
 	if res.Error == nil {
 		return false, nil
 	}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeleteAccount - Schedule the caller's account for deletion and log it out everywhere.
+// The account can be restored until the grace period ends.
+func (h *Handler) DeleteAccount(ctx *gin.Context) {
+	var req model.DeleteAccountRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	userID := TokenMetaData(ctx).UserID
+	user, err := h.UserAPIService.GetWithID(userID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	switch {
+	case req.Password != "":
+		authed, err := h.UserAPIService.Authenticate(user.Email, req.Password)
+		if err == nil && authed.ID != user.ID {
+			err = api.ErrInvalidCredentials
+		}
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+	case req.Ticket != "":
+		if err := h.OTPAPIService.RedeemTicket(req.Ticket, api.OTPPurposeVerify, user.Email); err != nil {
+			ctx.Error(err)
+			return
+		}
+	default:
+		ctx.Error(apperror.InvalidMessage("Password or ticket is required"))
+		return
+	}
+	if err := h.UserAPIService.Delete(userID); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(userID, ""); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Account scheduled for deletion")
+}
+
+// SendAccountEmail - Mail a verification code to the caller's own address,
+// the ticket confirms account deletion for users without a password
+func (h *Handler) SendAccountEmail(ctx *gin.Context) {
+	user, err := h.UserAPIService.GetWithID(TokenMetaData(ctx).UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if user.Email == "" {
+		ctx.Error(apperror.InvalidMessage("Account has no email"))
+		return
+	}
+	if err := h.OTPAPIService.SendEmail(user.Email, acceptedLocale(ctx)); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully sent email")
+}
+
+// RestoreAccount - Cancel deletion of a local account and log in
+func (h *Handler) RestoreAccount(ctx *gin.Context) {
+	var cred model.Credentials
+	if err := ctx.ShouldBindJSON(&cred); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	user, err := h.checkPassword(ctx, cred.Email, cred.Password)
+	switch {
+	case err == nil:
+		ctx.Error(api.ErrAccountNotDeleted)
+		return
+	case !errors.Is(err, api.ErrAccountDeleted):
+		ctx.Error(err)
+		return
+	}
+	if err := h.UserAPIService.Restore(user.ID); err != nil {
+		ctx.Error(err)
+		return
+	}
+	user.DeletedAt = nil
+	if user.SuspendedAt != nil {
+		ctx.Error(api.ErrAccountSuspended)
+		return
+	}
+	h.login(ctx, user)
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ListUsers - Search users, ?q= matches email, name or nickname, ?page= starts at 1
+func (h *Handler) ListUsers(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid page"))
+		return
+	}
+	size, err := strconv.Atoi(ctx.DefaultQuery("size", strconv.Itoa(defaultPageSize)))
+	if err != nil || size < 1 || size > maxPageSize {
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid size"))
+		return
+	}
+	users, total, err := h.UserAPIService.ListUsers(ctx.Query("q"), (page-1)*size, size)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, model.UserPage{Users: users, Total: total, Page: page, Size: size})
+}
+
+// SuspendUser - Block sign in and log the user out everywhere.
+// Only admins can suspend users that hold a role themselves.
+func (h *Handler) SuspendUser(ctx *gin.Context) {
+	userID, ok := adminTarget(ctx)
+	if !ok {
+		return
+	}
+	if !h.canActOnTarget(ctx, userID, "Only admins can suspend staff") {
+		return
+	}
+	if err := h.UserAPIService.Suspend(userID); err != nil {
+		adminFailed(ctx, err)
+		return
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(userID, ""); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully suspended user")
+}
+
+// UnsuspendUser - Allow sign in again, with the same restriction on staff as SuspendUser
+func (h *Handler) UnsuspendUser(ctx *gin.Context) {
+	userID, ok := adminTarget(ctx)
+	if !ok {
+		return
+	}
+	if !h.canActOnTarget(ctx, userID, "Only admins can unsuspend staff") {
+		return
+	}
+	if err := h.UserAPIService.Unsuspend(userID); err != nil {
+		adminFailed(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully unsuspended user")
+}
+
+// SetUserRoles - Replace roles of the user, its sessions are revoked so new tokens carry them
+func (h *Handler) SetUserRoles(ctx *gin.Context) {
+	userID, ok := adminTarget(ctx)
+	if !ok {
+		return
+	}
+	var req model.RolesRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	if err := h.UserAPIService.SetRoles(userID, req.Roles); err != nil {
+		adminFailed(ctx, err)
+		return
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(userID, ""); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, req)
+}
+
+// canActOnTarget - Moderators can only act on users without a role, message is the error otherwise
+func (h *Handler) canActOnTarget(ctx *gin.Context, userID uint64, message string) bool {
+	if hasRole(TokenMetaData(ctx).Roles, model.RoleAdmin) {
+		return true
+	}
+	roles, err := h.UserAPIService.GetRoles(userID)
+	if err != nil {
+		ctx.Error(err)
+		return false
+	}
+	if len(roles) > 0 {
+		ctx.Error(apperror.New(apperror.CodeForbidden, http.StatusForbidden, message))
+		return false
+	}
+	return true
+}
+
+// adminTarget - User id of the route, admins cannot act on themselves
+func adminTarget(ctx *gin.Context) (uint64, bool) {
+	userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid user id"))
+		return 0, false
+	}
+	if userID == TokenMetaData(ctx).UserID {
+		ctx.Error(apperror.New(apperror.CodeSelfAction, http.StatusConflict, "Cannot change your own account"))
+		return 0, false
+	}
+	return userID, true
+}
+
+func adminFailed(ctx *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = errUserNotFound.Wrap(err)
+	}
+	ctx.Error(err)
+}
+
+// ListMail - Delivery state of mail sent to ?to=, or of all dead-lettered mail with ?status=dead
+func (h *Handler) ListMail(ctx *gin.Context) {
+	var query model.MailQuery
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	var jobs []model.MailJob
+	var err error
+	if query.Status == model.MailDead {
+		jobs, err = h.MailQueueAPIService.ListDead()
+	} else {
+		jobs, err = h.MailQueueAPIService.ListByRecipient(query.To)
+	}
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, jobs)
+}
+
+func (h *Handler) GetMail(ctx *gin.Context) {
+	job, err := h.MailQueueAPIService.Get(ctx.Param("id"))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, job)
+}
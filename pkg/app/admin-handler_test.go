@@ -0,0 +1,42 @@
+package app
+
+import (
+	"net/http"
+	"pdserver/pkg/api/model"
+	"strconv"
+	"testing"
+)
+
+// staff - Register a user holding the roles and sign in again so the token carries them
+func (s *testServer) staff(email string, nickname string, roles ...string) model.LoginResponse {
+	s.t.Helper()
+	registered := s.register(email, nickname, "password123")
+	if err := s.users.SetRoles(registered.User.ID, roles); err != nil {
+		s.t.Fatal(err)
+	}
+	w := s.login(email, "password123")
+	expectStatus(s.t, w, http.StatusOK)
+	var res model.LoginResponse
+	decode(s.t, w, &res)
+	return res
+}
+
+func TestModeratorCannotActOnStaff(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.staff("admin@example.com", "admin", model.RoleAdmin)
+	moderator := s.staff("mod@example.com", "moderator", model.RoleModerator)
+	other := s.staff("other@example.com", "othermod", model.RoleModerator)
+	user := s.register("user@example.com", "planty", "password123")
+	suspension := func(id uint64) string { return "/admin/users/" + strconv.FormatUint(id, 10) + "/suspension" }
+
+	expectStatus(t, s.request("POST", suspension(user.User.ID), nil, moderator.Token.AccessToken), http.StatusOK)
+	expectStatus(t, s.request("DELETE", suspension(user.User.ID), nil, moderator.Token.AccessToken), http.StatusOK)
+
+	expectError(t, s.request("POST", suspension(other.User.ID), nil, moderator.Token.AccessToken), http.StatusForbidden, "forbidden")
+	expectStatus(t, s.request("POST", suspension(other.User.ID), nil, admin.Token.AccessToken), http.StatusOK)
+	// Lifting the suspension of staff is as restricted as imposing it
+	expectError(t, s.request("DELETE", suspension(other.User.ID), nil, moderator.Token.AccessToken), http.StatusForbidden, "forbidden")
+	expectError(t, s.login("other@example.com", "password123"), http.StatusForbidden, "account_suspended")
+	expectStatus(t, s.request("DELETE", suspension(other.User.ID), nil, admin.Token.AccessToken), http.StatusOK)
+	expectStatus(t, s.login("other@example.com", "password123"), http.StatusOK)
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// apiErrors - Codes of the api package errors, their messages are safe to show
+var apiErrors = []struct {
+	err    error
+	code   apperror.Code
+	status int
+}{
+	{api.ErrInvalidCredentials, apperror.CodeInvalidCredentials, http.StatusUnauthorized},
+	{api.ErrTokenExpired, apperror.CodeTokenExpired, http.StatusUnauthorized},
+	{api.ErrTokenRevoked, apperror.CodeTokenRevoked, http.StatusUnauthorized},
+	{api.ErrTokenMalformed, apperror.CodeTokenMalformed, http.StatusUnauthorized},
+	{api.ErrRefreshTokenRevoked, apperror.CodeTokenRevoked, http.StatusUnauthorized},
+	{api.ErrRefreshTokenMalformed, apperror.CodeTokenMalformed, http.StatusUnauthorized},
+	{api.ErrRefreshTokenReused, apperror.CodeRefreshTokenReused, http.StatusUnauthorized},
+	{api.ErrUnknownKey, apperror.CodeTokenMalformed, http.StatusUnauthorized},
+	{api.ErrInvalidCode, apperror.CodeInvalidCode, http.StatusUnauthorized},
+	{api.ErrCodeExpired, apperror.CodeCodeExpired, http.StatusUnauthorized},
+	{api.ErrTooManyAttempts, apperror.CodeTooManyAttempts, http.StatusTooManyRequests},
+	{api.ErrInvalidTicket, apperror.CodeEmailNotVerified, http.StatusForbidden},
+	{api.ErrInvalidAuthCode, apperror.CodeInvalidAuthCode, http.StatusUnauthorized},
+	{api.ErrInvalidRedirectURI, apperror.CodeInvalidRedirectURI, http.StatusBadRequest},
+	{api.ErrInvalidLinkTicket, apperror.CodeInvalidLinkTicket, http.StatusUnauthorized},
+	{api.ErrInvalidOAuthState, apperror.CodeInvalidOAuthState, http.StatusUnauthorized},
+	{api.ErrUnknownProvider, apperror.CodeUnknownProvider, http.StatusNotFound},
+	{api.ErrAccountDeleted, apperror.CodeAccountDeleted, http.StatusForbidden},
+	{api.ErrAccountSuspended, apperror.CodeAccountSuspended, http.StatusForbidden},
+	{api.ErrAccountLocked, apperror.CodeAccountLocked, http.StatusLocked},
+	{api.ErrLoginDelayed, apperror.CodeLoginDelayed, http.StatusTooManyRequests},
+	{api.ErrIPLocked, apperror.CodeIPLocked, http.StatusTooManyRequests},
+	{api.ErrAccountNotDeleted, apperror.CodeAccountNotDeleted, http.StatusConflict},
+	{api.ErrAccountEmailExists, apperror.CodeAccountExists, http.StatusConflict},
+	{api.ErrIdentityInUse, apperror.CodeIdentityInUse, http.StatusConflict},
+	{api.ErrProviderLinked, apperror.CodeProviderLinked, http.StatusConflict},
+	{api.ErrIdentityNotFound, apperror.CodeIdentityNotFound, http.StatusNotFound},
+	{api.ErrLastLoginMethod, apperror.CodeLastLoginMethod, http.StatusConflict},
+	{api.ErrSessionNotFound, apperror.CodeSessionNotFound, http.StatusNotFound},
+	{api.ErrMailNotFound, apperror.CodeMailNotFound, http.StatusNotFound},
+	{api.ErrTwoFactorEnabled, apperror.CodeTwoFactorEnabled, http.StatusConflict},
+	{api.ErrTwoFactorNotEnabled, apperror.CodeTwoFactorNotEnabled, http.StatusConflict},
+	{api.ErrTwoFactorNotEnrolled, apperror.CodeTwoFactorNotEnrolled, http.StatusConflict},
+	{api.ErrInvalidTwoFactorCode, apperror.CodeInvalidTwoFactorCode, http.StatusUnauthorized},
+	{api.ErrInvalidMFAChallenge, apperror.CodeInvalidMFAChallenge, http.StatusUnauthorized},
+	{api.ErrUnknownRole, apperror.CodeUnknownRole, http.StatusUnprocessableEntity},
+}
+
+var (
+	errUserNotFound  = apperror.New(apperror.CodeUserNotFound, http.StatusNotFound, "User not found")
+	errNicknameTaken = apperror.New(apperror.CodeNicknameTaken, http.StatusConflict, "Unavailable nickname")
+	errEmailTaken    = apperror.New(apperror.CodeEmailTaken, http.StatusConflict, "Cannot use this email")
+	errRateLimited   = apperror.New(apperror.CodeRateLimited, http.StatusTooManyRequests, "Too many requests")
+)
+
+// ErrorMiddleware - Tag the request with an id and render the last error added with ctx.Error
+// as {code, message, details, request_id}. Handlers add the error and return without writing.
+func ErrorMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestID := ctx.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.NewString()
+		}
+		ctx.Set(requestIDKey, requestID)
+		ctx.Header(requestIDHeader, requestID)
+		ctx.Next()
+		if len(ctx.Errors) == 0 || ctx.Writer.Written() {
+			return
+		}
+		err := ctx.Errors.Last().Err
+		appErr := resolveError(err)
+		if appErr.Code == apperror.CodeInvalidRequest && appErr.Details == nil {
+			if details := validationDetails(ctx, err); details != nil {
+				appErr = appErr.WithDetails(details)
+			}
+		}
+		if appErr.Status >= http.StatusInternalServerError {
+			log.Printf("request %s: %s", requestID, err.Error())
+		}
+		ctx.JSON(appErr.Status, model.ErrorResponse{
+			Code:      string(appErr.Code),
+			Message:   appErr.Message,
+			Details:   appErr.Details,
+			RequestID: requestID,
+		})
+	}
+}
+
+// resolveError - Client facing error for err
+func resolveError(err error) *apperror.Error {
+	var appErr *apperror.Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	for _, mapped := range apiErrors {
+		if errors.Is(err, mapped.err) {
+			return &apperror.Error{Code: mapped.code, Status: mapped.status, Message: mapped.err.Error(), Err: err}
+		}
+	}
+	return apperror.From(err)
+}
+
+// abort - Stop the chain and let ErrorMiddleware respond with err
+func abort(ctx *gin.Context, err error) {
+	ctx.Error(err)
+	ctx.Abort()
+}
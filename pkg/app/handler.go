@@ -2,113 +2,264 @@ package app
 
 import (
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"pdserver/pkg/api"
 	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"pdserver/pkg/mailer"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
-	"golang.org/x/oauth2"
 )
 
 type Handler struct {
-	Engin           *gin.Engine
-	UserAPIService  *api.UserDB
-	TokenAPIService *api.TokenDB
-	NaverAPIService *api.NaverOAuth
-	OTPAPIService   *api.OTPAPIService
+	Engin               *gin.Engine
+	UserAPIService      api.UserAPIService
+	TokenAPIService     api.TokenAPIService
+	OAuthAPIService     api.OAuthAPIService
+	OTPAPIService       api.OTPAPIService
+	HandoffAPIService   api.HandoffAPIService
+	MailQueueAPIService api.MailQueueAPIService
+	RateLimitAPIService api.RateLimitAPIService
+	LockoutAPIService   api.LockoutAPIService
+	TwoFactorAPIService api.TwoFactorAPIService
 }
 
-func NewHandler(userService *api.UserDB, tokenService *api.TokenDB, naverService *api.NaverOAuth, otpService *api.OTPAPIService) *Handler {
+func NewHandler(userService api.UserAPIService, tokenService api.TokenAPIService, oauthService api.OAuthAPIService, otpService api.OTPAPIService, handoffService api.HandoffAPIService, mailQueue api.MailQueueAPIService, rateLimiter api.RateLimitAPIService, lockout api.LockoutAPIService, twoFactor api.TwoFactorAPIService) *Handler {
 	return &Handler{
-		Engin:           gin.Default(),
-		UserAPIService:  userService,
-		TokenAPIService: tokenService,
-		NaverAPIService: naverService,
-		OTPAPIService:   otpService,
+		Engin:               newEngine(),
+		UserAPIService:      userService,
+		TokenAPIService:     tokenService,
+		OAuthAPIService:     oauthService,
+		OTPAPIService:       otpService,
+		HandoffAPIService:   handoffService,
+		MailQueueAPIService: mailQueue,
+		RateLimitAPIService: rateLimiter,
+		LockoutAPIService:   lockout,
+		TwoFactorAPIService: twoFactor,
 	}
 }
 
+// SetTrustedProxies - Proxies whose X-Forwarded-For gives the client IP, see config.ServerConfig
+func (h *Handler) SetTrustedProxies(proxies []string) error {
+	return h.Engin.SetTrustedProxies(proxies)
+}
+
+func newEngine() *gin.Engine {
+	engine := gin.Default()
+	// gin trusts every proxy by default, anyone could pick the IP rate limits and lockouts count
+	engine.SetTrustedProxies(nil)
+	engine.Use(ErrorMiddleware())
+	engine.NoRoute(func(ctx *gin.Context) {
+		ctx.Error(apperror.New(apperror.CodeNotFound, http.StatusNotFound, "Route not found"))
+	})
+	return engine
+}
+
 func (h *Handler) LocalRegister(ctx *gin.Context) {
-	var user model.User
-	if err := ctx.ShouldBindJSON(&user); err != nil {
-		ctx.JSON(http.StatusUnprocessableEntity, err.Error())
+	var req model.RegisterRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
 		return
 	}
+	if !h.emailAvailable(ctx, req.Email) || !h.nicknameAvailable(ctx, req.Nickname) {
+		return
+	}
+	if err := h.OTPAPIService.RedeemTicket(req.Ticket, api.OTPPurposeVerify, req.Email); err != nil {
+		ctx.Error(err)
+		return
+	}
+	user := req.User()
 	if err := h.UserAPIService.Post(&user); err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
-	token, err := h.Authenticate(user.ID)
+	token, err := h.Authenticate(ctx, user.ID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
 	ctx.JSON(http.StatusOK, model.LoginResponse{Token: *token, User: user})
 }
 
 func (h *Handler) LocalLogin(ctx *gin.Context) {
-	var user model.User
-	if err := ctx.ShouldBindJSON(user); err != nil {
-		ctx.JSON(http.StatusUnprocessableEntity, err.Error())
+	var cred model.Credentials
+	if err := ctx.ShouldBindJSON(&cred); err != nil {
+		ctx.Error(apperror.Invalid(err))
 		return
 	}
-	_, err := h.UserAPIService.Get(&user)
+	user, err := h.checkPassword(ctx, cred.Email, cred.Password)
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, err.Error())
+		ctx.Error(err)
 		return
 	}
-	token, err := h.Authenticate(user.ID)
+	h.login(ctx, user)
+}
+
+// OAuthLogin - Redirect to the provider.
+// The app sends ?redirect_uri= and an S256 ?code_challenge= for the code it later exchanges,
+// ?restore=true cancels deletion of the account being signed in to.
+func (h *Handler) OAuthLogin(ctx *gin.Context) {
+	redirectURI, err := h.HandoffAPIService.RedirectURI(ctx.Query("redirect_uri"))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
-	ctx.JSON(http.StatusOK, model.LoginResponse{Token: *token, User: user})
+	if ctx.Query("code_challenge") == "" || ctx.Query("code_challenge_method") != "S256" {
+		ctx.Error(apperror.InvalidMessage("S256 code_challenge is required"))
+		return
+	}
+	h.startOAuth(ctx, api.OAuthState{AppRedirectURI: redirectURI, AppCodeChallenge: ctx.Query("code_challenge"),
+		Restore: ctx.Query("restore") == "true"})
 }
 
-func (h *Handler) NaverLogin(ctx *gin.Context) {
-	url := h.NaverAPIService.Config.AuthCodeURL(h.NaverAPIService.State, oauth2.AccessTypeOffline)
-	http.Redirect(ctx.Writer, ctx.Request, url, http.StatusTemporaryRedirect)
+// OAuthLink - Redirect to the provider to link it to the user of the ticket from LinkIdentity.
+// The ticket is posted as a form field so it stays out of URLs and browser history.
+func (h *Handler) OAuthLink(ctx *gin.Context) {
+	redirectURI, err := h.HandoffAPIService.RedirectURI(ctx.PostForm("redirect_uri"))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ticket := ctx.PostForm("ticket")
+	if ticket == "" {
+		ctx.Error(api.ErrInvalidLinkTicket)
+		return
+	}
+	// Tickets posted from a browser other than the one they were handed to are refused
+	binding, _ := ctx.Cookie(api.OAuthLinkCookie)
+	ctx.SetSameSite(http.SameSiteNoneMode)
+	ctx.SetCookie(api.OAuthLinkCookie, "", -1, "/auth", "", true, true)
+	userID, err := h.OAuthAPIService.ConsumeLinkTicket(ticket, binding)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	h.startOAuth(ctx, api.OAuthState{AppRedirectURI: redirectURI, LinkUserID: userID})
+}
+
+// startOAuth - Bind a new state to the browser with a cookie and send the browser to the provider.
+// SameSite=None lets the cookie through on providers that post back to the callback, like Apple.
+func (h *Handler) startOAuth(ctx *gin.Context, app api.OAuthState) {
+	app.BrowserBinding = uuid.NewString()
+	loginURL, err := h.OAuthAPIService.LoginURL(ctx.Param("provider"), app)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.SetSameSite(http.SameSiteNoneMode)
+	ctx.SetCookie(api.OAuthBindingCookie, app.BrowserBinding, int(api.OAuthStateTTL.Seconds()), "/auth", "", true, true)
+	http.Redirect(ctx.Writer, ctx.Request, loginURL, http.StatusTemporaryRedirect)
 }
 
-func (h *Handler) NaverCallback(ctx *gin.Context) {
-	naverToken, err := h.NaverAPIService.Auth(ctx.Writer, *ctx.Request)
+func (h *Handler) OAuthCallback(ctx *gin.Context) {
+	provider := ctx.Param("provider")
+	oauthToken, oauthState, err := h.OAuthAPIService.Auth(provider, ctx.Request)
+	ctx.SetSameSite(http.SameSiteNoneMode)
+	ctx.SetCookie(api.OAuthBindingCookie, "", -1, "/auth", "", true, true)
 	if err != nil {
-		ctx.Redirect(http.StatusUnauthorized, "plantdoctor://")
+		// Without a valid state we don't know which app uri asked, use the default one
+		redirectURI, _ := h.HandoffAPIService.RedirectURI("")
+		oauthFailed(ctx, redirectURI, "unauthorized", err)
 		return
 	}
-	user, err := h.NaverAPIService.GetUser(naverToken)
+	redirectURI := oauthState.AppRedirectURI
+	profile, err := h.OAuthAPIService.GetProfile(provider, oauthToken)
 	if err != nil {
-		ctx.Redirect(http.StatusInternalServerError, "plantdoctor://")
+		oauthFailed(ctx, redirectURI, "server_error", err)
 		return
 	}
-	foundUser, err := h.UserAPIService.Get(user)
+	if oauthState.LinkUserID != 0 {
+		h.linkCallback(ctx, provider, oauthState, profile)
+		return
+	}
+	foundUser, err := h.UserAPIService.GetByIdentity(provider, profile.ProviderUserID)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		if err = h.UserAPIService.Post(user); err != nil {
-			ctx.Redirect(http.StatusInternalServerError, "plantdoctor://")
+		foundUser, err = h.signUpWithIdentity(provider, profile)
+	}
+	// Identities stay linked until the account is purged, a deleted account is never signed in to
+	// without the user asking to restore it. restore=true tells the app to offer starting over with it.
+	if errors.Is(err, api.ErrAccountDeleted) {
+		if !oauthState.Restore {
+			log.Println(err.Error())
+			appRedirect(ctx, redirectURI, url.Values{"error": {"account_deleted"}, "restore": {"true"}})
 			return
-		} else {
-			foundUser = user
 		}
+		err = h.UserAPIService.Restore(foundUser.ID)
+	}
+	if errors.Is(err, api.ErrAccountSuspended) {
+		oauthFailed(ctx, redirectURI, "account_suspended", err)
+		return
+	}
+	if errors.Is(err, api.ErrAccountEmailExists) {
+		oauthFailed(ctx, redirectURI, "account_exists", err)
+		return
+	}
+	if err != nil {
+		oauthFailed(ctx, redirectURI, "server_error", err)
+		return
+	}
+	code, err := h.HandoffAPIService.CreateCode(foundUser.ID, oauthState.AppCodeChallenge, redirectURI)
+	if err != nil {
+		oauthFailed(ctx, redirectURI, "server_error", err)
+		return
 	}
+	appRedirect(ctx, redirectURI, url.Values{"code": {code}})
+}
+
+// ExchangeCode - Tokens for the code the app received from OAuthCallback.
+// Provider sign ins only end here, users with two-factor enabled get a challenge for /auth/2fa instead.
+func (h *Handler) ExchangeCode(ctx *gin.Context) {
+	var req model.ExchangeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	userID, err := h.HandoffAPIService.Exchange(req.Code, req.CodeVerifier, req.RedirectURI)
 	if err != nil {
-		ctx.Redirect(http.StatusInternalServerError, "plantdoctor://")
+		ctx.Error(err)
 		return
 	}
-	token, err := h.Authenticate(foundUser.ID)
+	if h.challenged(ctx, userID) {
+		return
+	}
+	token, err := h.Authenticate(ctx, userID)
 	if err != nil {
-		ctx.Redirect(http.StatusInternalServerError, "plantdoctor://")
+		ctx.Error(err)
 		return
 	}
-	userID := strconv.FormatUint(foundUser.ID, 10)
-	ctx.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("plantdoctor://?access_token=%s&&refresh_token=%s&&user_id=%s", token.AccessToken, token.RefreshToken, userID))
+	ctx.JSON(http.StatusOK, token)
 }
 
-func (h *Handler) Authenticate(userID uint64) (*model.Token, error) {
-	tmd, err := h.TokenAPIService.Create(userID)
+// oauthFailed - Send the app back with the failure reason
+func oauthFailed(ctx *gin.Context, redirectURI string, reason string, err error) {
+	log.Println(err.Error())
+	appRedirect(ctx, redirectURI, url.Values{"error": {reason}})
+}
+
+// appRedirect - Redirect to an allowed app uri with params added to its query
+func appRedirect(ctx *gin.Context, redirectURI string, params url.Values) {
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	ctx.Redirect(http.StatusTemporaryRedirect, redirectURI+sep+params.Encode())
+}
+
+// Authenticate - Start a session for the user on the calling device, its current roles go into the tokens
+func (h *Handler) Authenticate(ctx *gin.Context, userID uint64) (*model.Token, error) {
+	device := deviceInfo(ctx)
+	roles, err := h.UserAPIService.GetRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+	tmd, err := h.TokenAPIService.Create(userID, roles, device)
 	if err != nil {
 		return nil, err
 	}
@@ -116,140 +267,172 @@ func (h *Handler) Authenticate(userID uint64) (*model.Token, error) {
 	if err != nil {
 		return nil, err
 	}
+	h.notifyNewDevice(ctx, userID, device)
 	return token, nil
 }
 
+// notifyNewDevice - Mail the user when they sign in from a device they never used before.
+// Failures are only logged, they must not fail the sign in.
+func (h *Handler) notifyNewDevice(ctx *gin.Context, userID uint64, device model.DeviceInfo) {
+	isNew, err := h.TokenAPIService.RememberDevice(userID, device)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if !isNew {
+		return
+	}
+	user, err := h.UserAPIService.GetWithID(userID)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if user.Email == "" {
+		return
+	}
+	name := device.DeviceName
+	if name == "" {
+		name = device.UserAgent
+	}
+	data := map[string]string{"device": name, "ip": device.IP, "time": time.Now().UTC().Format("2006-01-02 15:04 MST")}
+	locale := acceptedLocale(ctx)
+	if err := h.MailQueueAPIService.Send(user.Email, mailer.TemplateNewDevice, locale, data); err != nil {
+		log.Println(err.Error())
+	}
+}
+
 func (h *Handler) SendEmail(ctx *gin.Context) {
-	email := ctx.Query("email")
-	if email == "" {
-		ctx.JSON(http.StatusUnprocessableEntity, "Wrong query")
+	var query model.EmailQuery
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	available, err := h.UserAPIService.Available(query.Email, "email")
+	if err != nil {
+		ctx.Error(err)
 		return
 	}
-	available, err := h.UserAPIService.Available(email, "email")
 	if !available {
-		if err == nil {
-			ctx.JSON(http.StatusConflict, "Cannot use this email")
-		} else {
-			ctx.JSON(http.StatusInternalServerError, err.Error())
-		}
+		ctx.Error(errEmailTaken)
 		return
 	}
-	err = h.OTPAPIService.SendEmail(email)
+	err = h.OTPAPIService.SendEmail(query.Email, acceptedLocale(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
 	ctx.JSON(http.StatusOK, "Successfully sent email")
 }
 
 func (h *Handler) VerifyCode(ctx *gin.Context) {
-	emailJson := map[string]string{}
-	if err := ctx.ShouldBindJSON(&emailJson); err != nil {
-		ctx.JSON(http.StatusUnprocessableEntity, err.Error())
+	var req model.VerifyCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
 		return
 	}
-	code := emailJson["code"]
-	isValidCode := h.OTPAPIService.Validate(code)
-	if isValidCode {
-		ctx.JSON(http.StatusOK, "Success")
-	} else {
-		ctx.JSON(http.StatusUnauthorized, "Failed")
+	ticket, err := h.OTPAPIService.Verify(api.OTPPurposeVerify, req.Email, req.Code)
+	if err != nil {
+		ctx.Error(err)
+		return
 	}
+	ctx.JSON(http.StatusOK, model.VerificationResponse{Ticket: ticket})
 }
 
 func (h *Handler) Available(ctx *gin.Context) {
-	nickname := ctx.Query("nickname")
-	if nickname == "" {
-		ctx.JSON(http.StatusUnprocessableEntity, "Invalid query")
+	var query model.NicknameQuery
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	res, err := h.UserAPIService.Available(query.Nickname, "nickname")
+	if err != nil {
+		ctx.Error(err)
 		return
 	}
-	res, err := h.UserAPIService.Available(nickname, "nickname")
 	if !res {
-		if err == nil {
-			ctx.JSON(http.StatusConflict, "Unavailable nickname")
-		} else {
-			ctx.JSON(http.StatusInternalServerError, err.Error())
-		}
+		ctx.Error(errNicknameTaken)
 		return
 	}
 	ctx.JSON(http.StatusOK, "Available")
 }
 
 func (h *Handler) Logout(ctx *gin.Context) {
-	accessToken, err := h.ExtractAccessToken(ctx.Request)
-	if err != nil {
-		ctx.JSON(http.StatusUnprocessableEntity, err.Error())
-		return
-	}
-	tmd, err := h.TokenAPIService.GetTokenMetaData(accessToken)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, err.Error())
-		return
-	}
+	tmd := TokenMetaData(ctx)
 	if err := h.TokenAPIService.Delete(tmd); err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
 	ctx.JSON(http.StatusOK, "Successfully logged out")
 }
 
 func (h *Handler) RefreshToken(ctx *gin.Context) {
-	mapToken := map[string]string{}
-	if err := ctx.ShouldBindJSON(&mapToken); err != nil {
-		ctx.JSON(http.StatusUnprocessableEntity, err.Error())
+	var req model.RefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
 		return
 	}
-	refreshToken := mapToken["refresh_token"]
-	token, err := h.TokenAPIService.RePost(refreshToken)
+	token, err := h.TokenAPIService.RePost(req.RefreshToken)
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, err.Error())
+		ctx.Error(err)
 		return
 	}
 	ctx.JSON(http.StatusOK, token)
 }
 
+// GetUser - Deprecated ?user_id= lookup, the full profile is only returned for the caller
 func (h *Handler) GetUser(ctx *gin.Context) {
 	userIDStr := ctx.Query("user_id")
 	if userIDStr == "" {
-		ctx.JSON(http.StatusBadRequest, "Invalid userID query")
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid userID query"))
 		return
 	}
 	userID, err := strconv.ParseUint(userIDStr, 10, 64)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, err.Error())
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid userID query").Wrap(err))
 		return
 	}
-	user, err := h.UserAPIService.GetWithID(userID)
+	if userID == TokenMetaData(ctx).UserID {
+		h.GetMe(ctx)
+		return
+	}
+	h.publicProfile(ctx, userID)
+}
+
+// GetMe - Full profile of the caller
+func (h *Handler) GetMe(ctx *gin.Context) {
+	user, err := h.UserAPIService.GetWithID(TokenMetaData(ctx).UserID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, err.Error())
+		ctx.Error(err)
 		return
 	}
 	ctx.JSON(http.StatusOK, user)
 }
 
-func (h *Handler) ValidateTokenMiddleware() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		accessToken, err := h.ExtractAccessToken(ctx.Request)
-		if err != nil {
-			ctx.JSON(http.StatusUnprocessableEntity, err.Error())
-			ctx.Abort()
-			return
-		}
-		if err := h.TokenAPIService.Validate(accessToken); err != nil {
-			fmt.Println(err.Error())
-			ctx.JSON(http.StatusUnauthorized, err.Error())
-			ctx.Abort()
-			return
-		}
-		ctx.Next()
+// GetPublicUser - Public profile of any user, the caller's own included
+func (h *Handler) GetPublicUser(ctx *gin.Context) {
+	userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.Error(apperror.New(apperror.CodeInvalidRequest, http.StatusBadRequest, "Invalid user id"))
+		return
 	}
+	h.publicProfile(ctx, userID)
 }
 
-func (h *Handler) ExtractAccessToken(r *http.Request) (string, error) {
-	authorization := r.Header.Get("Authorization")
-	strArr := strings.Split(authorization, " ")
-	if len(strArr) != 2 {
-		return "", fmt.Errorf("Invalid authorization")
+func (h *Handler) publicProfile(ctx *gin.Context, userID uint64) {
+	user, err := h.UserAPIService.GetWithID(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctx.Error(errUserNotFound.Wrap(err))
+		return
+	}
+	if err != nil {
+		ctx.Error(err)
+		return
 	}
-	return strArr[1], nil
+	ctx.JSON(http.StatusOK, user.Public())
+}
+
+// JWKS - Publish token verification keys for other services
+func (h *Handler) JWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=3600")
+	ctx.JSON(http.StatusOK, h.TokenAPIService.JWKS())
 }
@@ -0,0 +1,298 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"pdserver/pkg/mailer"
+	"pdserver/pkg/repository"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testServer - Handler wired to the in-memory services, as described in memory-api.go
+type testServer struct {
+	t       *testing.T
+	cfg     *config.Config
+	handler *Handler
+	store   *repository.MemoryStore
+	users   *api.MemoryUserDB
+	mail    *api.MemoryMailSender
+	oauth   *api.MemoryOAuth
+	auditor *api.MemoryAuditor
+}
+
+// syncMailQueue - Delivers mail within the request so tests can read it right away
+type syncMailQueue struct {
+	*api.MailQueue
+}
+
+func (q syncMailQueue) Send(to string, template string, locale string, data map[string]string) error {
+	job, err := q.Enqueue("", to, template, locale, data)
+	if err != nil {
+		return err
+	}
+	return q.Process(job.ID)
+}
+
+// newTestServer - Server with the default configuration and rate limits off, configure changes it first
+func newTestServer(t *testing.T, configure ...func(*config.Config)) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWT.AccessSecret, cfg.JWT.RefreshSecret = "access", "refresh"
+	cfg.JWT.KeyEncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	cfg.Password.Cost = 4
+	cfg.RateLimit.Enabled = false
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	s := &testServer{
+		t:       t,
+		cfg:     cfg,
+		store:   repository.NewMemoryStore(),
+		users:   api.NewMemoryUserDB(api.NewPasswordHasher(cfg.Password)),
+		mail:    api.NewMemoryMailSender(),
+		auditor: api.NewMemoryAuditor(),
+	}
+	s.oauth = api.NewMemoryOAuth(s.store, "naver", "kakao")
+	keyRing := api.NewKeyRing(s.store, cfg.JWT)
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	queue := syncMailQueue{api.NewMailQueue(s.store, s.mail, cfg.MailQueue)}
+	queue.ExpireAfter(cfg.OTP.CodeTTL, mailer.TemplateSignupCode, mailer.TemplatePasswordReset, mailer.TemplateAccountUnlock)
+	s.handler = NewHandler(s.users, api.NewTokenDB(s.store, keyRing, cfg.JWT, s.auditor, s.users), s.oauth,
+		api.NewOTPService(s.store, queue, cfg.OTP), api.NewAppHandoff(s.store, cfg.App), queue,
+		api.NewRateLimiter(s.store, cfg.RateLimit), api.NewLoginGuard(s.store, cfg.Lockout),
+		api.NewTwoFactor(s.users, s.store, cfg.TwoFactor, cfg.JWT.KeyEncryptionKey))
+	s.handler.SetupRoutes()
+	return s
+}
+
+// request - Serve one request, body is sent as JSON unless it is nil
+func (s *testServer) request(method string, path string, body interface{}, accessToken string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "en")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	s.handler.Engin.ServeHTTP(w, req)
+	return w
+}
+
+// mailedCode - Code of the last mail sent to the address
+func (s *testServer) mailedCode(email string) string {
+	s.t.Helper()
+	mail, ok := s.mail.Last(email)
+	if !ok || mail.Data["code"] == "" {
+		s.t.Fatalf("no code mailed to %s", email)
+	}
+	return mail.Data["code"]
+}
+
+// verifyEmail - Ticket for the address through /auth/mail and /auth/code
+func (s *testServer) verifyEmail(email string) string {
+	s.t.Helper()
+	expectStatus(s.t, s.request("GET", "/auth/mail?email="+email, nil, ""), http.StatusOK)
+	w := s.request("POST", "/auth/code", gin.H{"email": email, "code": s.mailedCode(email)}, "")
+	expectStatus(s.t, w, http.StatusOK)
+	var res model.VerificationResponse
+	decode(s.t, w, &res)
+	return res.Ticket
+}
+
+// register - Local account through the whole sign up flow
+func (s *testServer) register(email string, nickname string, password string) model.LoginResponse {
+	s.t.Helper()
+	ticket := s.verifyEmail(email)
+	w := s.request("POST", "/auth/local/new",
+		gin.H{"email": email, "nickname": nickname, "password": password, "ticket": ticket}, "")
+	expectStatus(s.t, w, http.StatusOK)
+	var res model.LoginResponse
+	decode(s.t, w, &res)
+	return res
+}
+
+func (s *testServer) login(email string, password string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.request("POST", "/auth/local", gin.H{"email": email, "password": password}, "")
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+}
+
+// expectError - Status and code of an error envelope
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	var res model.ErrorResponse
+	decode(t, w, &res)
+	if res.Code != code {
+		t.Fatalf("error code %q, want %q: %s", res.Code, code, w.Body.String())
+	}
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %s: %s", w.Body.String(), err.Error())
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := newTestServer(t)
+	registered := s.register("user@example.com", "planty", "password123")
+	if registered.Token.AccessToken == "" || registered.User.ID == 0 {
+		t.Fatalf("register returned %+v", registered)
+	}
+
+	expectError(t, s.login("user@example.com", "wrong-password"), http.StatusUnauthorized, "invalid_credentials")
+	expectError(t, s.login("nobody@example.com", "password123"), http.StatusUnauthorized, "invalid_credentials")
+	w := s.login("user@example.com", "password123")
+	expectStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "password") {
+		t.Fatalf("login response leaks the password: %s", w.Body.String())
+	}
+
+	var res model.LoginResponse
+	decode(t, w, &res)
+	me := s.request("GET", "/users/me", nil, res.Token.AccessToken)
+	expectStatus(t, me, http.StatusOK)
+	if strings.Contains(me.Body.String(), "password") || !strings.Contains(me.Body.String(), "user@example.com") {
+		t.Fatalf("unexpected profile %s", me.Body.String())
+	}
+}
+
+func TestRegisterRequiresTicket(t *testing.T) {
+	s := newTestServer(t)
+	body := gin.H{"email": "user@example.com", "nickname": "planty", "password": "password123", "ticket": "made-up"}
+	expectError(t, s.request("POST", "/auth/local/new", body, ""), http.StatusForbidden, "email_not_verified")
+
+	// A ticket only proves the address it was issued for
+	body["ticket"] = s.verifyEmail("other@example.com")
+	expectError(t, s.request("POST", "/auth/local/new", body, ""), http.StatusForbidden, "email_not_verified")
+}
+
+func TestPublicProfile(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.register("owner@example.com", "owner", "password123")
+	viewer := s.register("viewer@example.com", "viewer", "password123")
+
+	w := s.request("GET", "/users/1", nil, viewer.Token.AccessToken)
+	expectStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "owner@example.com") || !strings.Contains(w.Body.String(), "owner") {
+		t.Fatalf("public profile %s", w.Body.String())
+	}
+	expectError(t, s.request("GET", "/users/99", nil, owner.Token.AccessToken), http.StatusNotFound, "user_not_found")
+	expectError(t, s.request("GET", "/users/1", nil, ""), http.StatusUnauthorized, "unauthorized")
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	expectStatus(t, s.request("DELETE", "/auth", nil, res.Token.AccessToken), http.StatusOK)
+	expectError(t, s.request("GET", "/users/me", nil, res.Token.AccessToken), http.StatusUnauthorized, "token_revoked")
+}
+
+func TestUnknownRoute(t *testing.T) {
+	s := newTestServer(t)
+	expectError(t, s.request("GET", "/nowhere", nil, ""), http.StatusNotFound, "not_found")
+}
+
+func TestRegisterTicketIsSingleUse(t *testing.T) {
+	s := newTestServer(t)
+	ticket := s.verifyEmail("user@example.com")
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := gin.H{"email": "user@example.com", "nickname": "planty" + strconv.Itoa(i), "password": "password123", "ticket": ticket}
+			codes <- s.request("POST", "/auth/local/new", body, "").Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("one ticket created %d accounts", created)
+	}
+}
+
+func TestRegisterTakenEmailOrNickname(t *testing.T) {
+	s := newTestServer(t)
+	s.register("user@example.com", "planty", "password123")
+
+	ticket := s.verifyEmail("other@example.com")
+	body := gin.H{"email": "other@example.com", "nickname": "planty", "password": "password123", "ticket": ticket}
+	expectError(t, s.request("POST", "/auth/local/new", body, ""), http.StatusConflict, "nickname_taken")
+	// The ticket is still good after a refused nickname
+	body["nickname"] = "other"
+	expectStatus(t, s.request("POST", "/auth/local/new", body, ""), http.StatusOK)
+}
+
+func TestRegisterSameNicknameConcurrently(t *testing.T) {
+	s := newTestServer(t)
+	bodies := []gin.H{}
+	for i := 0; i < 5; i++ {
+		email := "user" + strconv.Itoa(i) + "@example.com"
+		bodies = append(bodies, gin.H{"email": email, "nickname": "planty", "password": "password123", "ticket": s.verifyEmail(email)})
+	}
+	codes := make(chan int, len(bodies))
+	var wg sync.WaitGroup
+	for _, body := range bodies {
+		wg.Add(1)
+		go func(body gin.H) {
+			defer wg.Done()
+			codes <- s.request("POST", "/auth/local/new", body, "").Code
+		}(body)
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("status %d", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d accounts with one nickname", created)
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+func (h *Handler) ListIdentities(ctx *gin.Context) {
+	identities, err := h.UserAPIService.ListIdentities(TokenMetaData(ctx).UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, identities)
+}
+
+// LinkIdentity - Start linking a provider, the app posts the ticket to the returned url in a browser.
+// The ticket is bound to the browser making this request with a cookie, so it has to be the one posting it.
+func (h *Handler) LinkIdentity(ctx *gin.Context) {
+	provider := ctx.Param("provider")
+	binding := uuid.NewString()
+	ticket, err := h.OAuthAPIService.CreateLinkTicket(TokenMetaData(ctx).UserID, binding)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.SetSameSite(http.SameSiteNoneMode)
+	ctx.SetCookie(api.OAuthLinkCookie, binding, int(api.LinkTicketTTL.Seconds()), "/auth", "", true, true)
+	ctx.JSON(http.StatusOK, model.LinkResponse{URL: "/auth/" + provider + "/link", Ticket: ticket})
+}
+
+func (h *Handler) UnlinkIdentity(ctx *gin.Context) {
+	err := h.UserAPIService.UnlinkIdentity(TokenMetaData(ctx).UserID, ctx.Param("provider"))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully unlinked")
+}
+
+// linkCallback - Finish linking started by LinkIdentity
+func (h *Handler) linkCallback(ctx *gin.Context, provider string, state *api.OAuthState, profile *model.OAuthProfile) {
+	err := h.UserAPIService.LinkIdentity(&model.Identity{UserID: state.LinkUserID, Provider: provider,
+		ProviderUserID: profile.ProviderUserID, Email: profile.User.Email})
+	switch {
+	case err == nil:
+		appRedirect(ctx, state.AppRedirectURI, url.Values{"linked": {provider}})
+	case errors.Is(err, api.ErrIdentityInUse), errors.Is(err, api.ErrProviderLinked):
+		oauthFailed(ctx, state.AppRedirectURI, "already_linked", err)
+	default:
+		oauthFailed(ctx, state.AppRedirectURI, "server_error", err)
+	}
+}
+
+// signUpWithIdentity - User for an external account seen for the first time
+func (h *Handler) signUpWithIdentity(provider string, profile *model.OAuthProfile) (*model.User, error) {
+	identity := &model.Identity{Provider: provider, ProviderUserID: profile.ProviderUserID, Email: profile.User.Email}
+	user := profile.User
+	// Naver users from before identities existed were matched on their profile fields.
+	// Only rows Naver sign in made qualify, accounts with a password or a linked identity
+	// belong to someone who signed up another way and are never taken over by profile fields.
+	if provider == "naver" && user.Email != "" {
+		found, err := h.UserAPIService.Get(&user)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			legacy, err := h.legacyNaverUser(found)
+			if err != nil {
+				return nil, err
+			}
+			if legacy {
+				identity.UserID = found.ID
+				return found, h.UserAPIService.LinkIdentity(identity)
+			}
+		}
+	}
+	if user.Email != "" {
+		available, err := h.UserAPIService.Available(user.Email, "email")
+		if err != nil {
+			return nil, err
+		}
+		if !available {
+			return nil, api.ErrAccountEmailExists
+		}
+	}
+	// Nicknames are unique, a taken one is left for the user to choose in their profile
+	if user.Nickname != "" {
+		available, err := h.UserAPIService.Available(user.Nickname, "nickname")
+		if err != nil {
+			return nil, err
+		}
+		if !available {
+			user.Nickname = ""
+		}
+	}
+	if err := h.UserAPIService.Post(&user); err != nil {
+		return nil, err
+	}
+	identity.UserID = user.ID
+	if err := h.UserAPIService.LinkIdentity(identity); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// legacyNaverUser - Whether the user was made by Naver sign in before identities existed
+func (h *Handler) legacyNaverUser(user *model.User) (bool, error) {
+	if user.Password != "" {
+		return false, nil
+	}
+	identities, err := h.UserAPIService.ListIdentities(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(identities) == 0, nil
+}
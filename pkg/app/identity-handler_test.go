@@ -0,0 +1,272 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"strings"
+	"testing"
+)
+
+// testVerifier - PKCE verifier the tests exchange handoff codes with
+const testVerifier = "test-verifier-test-verifier-test-verifier-test"
+
+func testChallenge() string {
+	sum := sha256.Sum256([]byte(testVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oauthLogin - Start a provider login, the provider url and the binding cookie set on the browser
+func (s *testServer) oauthLogin(provider string) (string, *http.Cookie) {
+	s.t.Helper()
+	w := s.request("GET", "/auth/"+provider+"?code_challenge_method=S256&code_challenge="+testChallenge(), nil, "")
+	return s.providerRedirect(w)
+}
+
+// startLink - Ask for a link ticket, with the cookie it is bound to
+func (s *testServer) startLink(provider string, accessToken string) (model.LinkResponse, *http.Cookie) {
+	s.t.Helper()
+	w := s.request("POST", "/users/me/identities/"+provider, nil, accessToken)
+	expectStatus(s.t, w, http.StatusOK)
+	var link model.LinkResponse
+	decode(s.t, w, &link)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == api.OAuthLinkCookie {
+			if !cookie.HttpOnly || !cookie.Secure {
+				s.t.Fatalf("link cookie %+v", cookie)
+			}
+			return link, cookie
+		}
+	}
+	s.t.Fatal("no link cookie set")
+	return link, nil
+}
+
+// postLink - Post a link ticket like the app's browser does
+func (s *testServer) postLink(link model.LinkResponse, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", link.URL, strings.NewReader(url.Values{"ticket": {link.Ticket}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handler.Engin.ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) providerRedirect(w *httptest.ResponseRecorder) (string, *http.Cookie) {
+	s.t.Helper()
+	expectStatus(s.t, w, http.StatusTemporaryRedirect)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == api.OAuthBindingCookie {
+			if !cookie.HttpOnly || !cookie.Secure {
+				s.t.Fatalf("binding cookie %+v", cookie)
+			}
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	s.t.Fatal("no binding cookie set")
+	return "", nil
+}
+
+// oauthCallback - Come back from the provider with code, the app redirect the server answers with
+func (s *testServer) oauthCallback(providerURL string, code string, binding *http.Cookie) *url.URL {
+	s.t.Helper()
+	req := httptest.NewRequest("GET", providerURL+"&code="+code, nil)
+	if binding != nil {
+		req.AddCookie(binding)
+	}
+	w := httptest.NewRecorder()
+	s.handler.Engin.ServeHTTP(w, req)
+	expectStatus(s.t, w, http.StatusTemporaryRedirect)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return location
+}
+
+func TestOAuthCallbackNeedsBrowserBinding(t *testing.T) {
+	s := newTestServer(t)
+	s.oauth.Register("code", model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+
+	// The attacker starts a login and sends the callback url to a victim
+	providerURL, _ := s.oauthLogin("naver")
+	if back := s.oauthCallback(providerURL, "code", nil); back.Query().Get("error") != "unauthorized" {
+		t.Fatalf("callback without cookie went to %s", back)
+	}
+	providerURL, _ = s.oauthLogin("naver")
+	_, otherBrowser := s.oauthLogin("naver")
+	if back := s.oauthCallback(providerURL, "code", otherBrowser); back.Query().Get("error") != "unauthorized" {
+		t.Fatalf("callback with another browser's cookie went to %s", back)
+	}
+
+	providerURL, binding := s.oauthLogin("naver")
+	if back := s.oauthCallback(providerURL, "code", binding); back.Query().Get("code") == "" {
+		t.Fatalf("callback went to %s", back)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	s.oauth.Register("kakao-code", model.OAuthProfile{ProviderUserID: "K1", User: model.User{Email: "k@example.com"}})
+
+	link, cookie := s.startLink("kakao", res.Token.AccessToken)
+	if strings.Contains(link.URL, link.Ticket) {
+		t.Fatalf("ticket in the link url %s", link.URL)
+	}
+	// Tickets in the query are not accepted any more
+	expectError(t, s.request("GET", "/auth/kakao?link="+link.Ticket, nil, ""), http.StatusUnprocessableEntity, "invalid_request")
+	// Nor from a browser the ticket was not handed to, the ticket is burned
+	expectError(t, s.postLink(link, nil), http.StatusUnauthorized, "invalid_link_ticket")
+	expectError(t, s.postLink(link, cookie), http.StatusUnauthorized, "invalid_link_ticket")
+	other, _ := s.startLink("kakao", res.Token.AccessToken)
+	link, cookie = s.startLink("kakao", res.Token.AccessToken)
+	expectError(t, s.postLink(other, cookie), http.StatusUnauthorized, "invalid_link_ticket")
+
+	providerURL, binding := s.providerRedirect(s.postLink(link, cookie))
+	if back := s.oauthCallback(providerURL, "kakao-code", binding); back.Query().Get("linked") != "kakao" {
+		t.Fatalf("link went to %s", back)
+	}
+	identities, err := s.users.ListIdentities(res.User.ID)
+	if err != nil || len(identities) != 1 || identities[0].ProviderUserID != "K1" {
+		t.Fatalf("identities %+v %v", identities, err)
+	}
+
+	// A ticket links once
+	expectError(t, s.postLink(link, cookie), http.StatusUnauthorized, "invalid_link_ticket")
+}
+
+// oauthCode - Handoff code of a provider login through to the app redirect
+func (s *testServer) oauthCode(provider string, code string) string {
+	s.t.Helper()
+	providerURL, binding := s.oauthLogin(provider)
+	back := s.oauthCallback(providerURL, code, binding)
+	if back.Query().Get("code") == "" {
+		s.t.Fatalf("login went to %s", back)
+	}
+	return back.Query().Get("code")
+}
+
+func TestExchangeCodeWithPKCE(t *testing.T) {
+	s := newTestServer(t)
+	for _, code := range []string{"c1", "c2", "c3"} {
+		s.oauth.Register(code, model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	}
+
+	// The code is burned by a wrong verifier
+	handoff := s.oauthCode("naver", "c1")
+	wrong := strings.Repeat("w", 43)
+	expectError(t, s.request("POST", "/auth/exchange", map[string]string{"code": handoff, "code_verifier": wrong}, ""),
+		http.StatusUnauthorized, "invalid_auth_code")
+	expectError(t, s.request("POST", "/auth/exchange", map[string]string{"code": handoff, "code_verifier": testVerifier}, ""),
+		http.StatusUnauthorized, "invalid_auth_code")
+
+	handoff = s.oauthCode("naver", "c2")
+	expectError(t, s.request("POST", "/auth/exchange",
+		map[string]string{"code": handoff, "code_verifier": testVerifier, "redirect_uri": "evil://"}, ""),
+		http.StatusUnauthorized, "invalid_auth_code")
+
+	handoff = s.oauthCode("naver", "c3")
+	w := s.request("POST", "/auth/exchange", map[string]string{"code": handoff, "code_verifier": testVerifier}, "")
+	expectStatus(t, w, http.StatusOK)
+	var token model.Token
+	decode(t, w, &token)
+	expectStatus(t, s.request("GET", "/users/me", nil, token.AccessToken), http.StatusOK)
+	expectError(t, s.request("POST", "/auth/exchange", map[string]string{"code": handoff, "code_verifier": testVerifier}, ""),
+		http.StatusUnauthorized, "invalid_auth_code")
+}
+
+func TestOAuthLoginChecksApp(t *testing.T) {
+	s := newTestServer(t)
+	expectError(t, s.request("GET", "/auth/naver", nil, ""), http.StatusUnprocessableEntity, "invalid_request")
+	expectError(t, s.request("GET", "/auth/naver?redirect_uri=evil://&code_challenge_method=S256&code_challenge="+testChallenge(), nil, ""),
+		http.StatusBadRequest, "invalid_redirect_uri")
+}
+
+// oauthSignIn - Tokens of a provider login exchanged like the app does
+func (s *testServer) oauthSignIn(provider string, code string) model.Token {
+	s.t.Helper()
+	handoff := s.oauthCode(provider, code)
+	w := s.request("POST", "/auth/exchange", map[string]string{"code": handoff, "code_verifier": testVerifier}, "")
+	expectStatus(s.t, w, http.StatusOK)
+	var token model.Token
+	decode(s.t, w, &token)
+	return token
+}
+
+func TestOAuthSignUpWithTakenNickname(t *testing.T) {
+	s := newTestServer(t)
+	s.register("user@example.com", "planty", "password123")
+	s.oauth.Register("code", model.OAuthProfile{ProviderUserID: "K1", User: model.User{Email: "k@example.com", Nickname: "planty"}})
+
+	token := s.oauthSignIn("kakao", "code")
+	w := s.request("GET", "/users/me", nil, token.AccessToken)
+	expectStatus(t, w, http.StatusOK)
+	var me model.User
+	decode(t, w, &me)
+	if me.Email != "k@example.com" || me.Nickname != "" {
+		t.Fatalf("signed up as %+v", me)
+	}
+}
+
+func TestNaverLegacyMatchSkipsOtherAccounts(t *testing.T) {
+	s := newTestServer(t)
+	s.register("n@example.com", "naver", "password123")
+	s.oauth.Register("c1", model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	providerURL, binding := s.oauthLogin("naver")
+	if back := s.oauthCallback(providerURL, "c1", binding); back.Query().Get("error") != "account_exists" {
+		t.Fatalf("password account matched on profile fields: %s", back)
+	}
+
+	// Rows of Naver sign in from before identities are still picked up
+	legacy := model.User{Email: "old@example.com", Nickname: "oldnaver"}
+	if err := s.users.Post(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	s.oauth.Register("c2", model.OAuthProfile{ProviderUserID: "N2", User: model.User{Email: "old@example.com", Nickname: "oldnaver"}})
+	token := s.oauthSignIn("naver", "c2")
+	w := s.request("GET", "/users/me", nil, token.AccessToken)
+	expectStatus(t, w, http.StatusOK)
+	var me model.User
+	decode(t, w, &me)
+	if me.ID != legacy.ID {
+		t.Fatalf("signed in as %+v", me)
+	}
+}
+
+func TestOAuthLoginToDeletedAccount(t *testing.T) {
+	s := newTestServer(t)
+	for _, code := range []string{"c1", "c2", "c3"} {
+		s.oauth.Register(code, model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	}
+	token := s.oauthSignIn("naver", "c1")
+	w := s.request("GET", "/users/me", nil, token.AccessToken)
+	var me model.User
+	decode(t, w, &me)
+	if err := s.users.Delete(me.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identity still points at the deleted user, signing in only offers to restore it
+	providerURL, binding := s.oauthLogin("naver")
+	back := s.oauthCallback(providerURL, "c2", binding)
+	if back.Query().Get("error") != "account_deleted" || back.Query().Get("restore") != "true" || back.Query().Get("code") != "" {
+		t.Fatalf("deleted account signed in: %s", back)
+	}
+
+	w = s.request("GET", "/auth/naver?restore=true&code_challenge_method=S256&code_challenge="+testChallenge(), nil, "")
+	providerURL, binding = s.providerRedirect(w)
+	back = s.oauthCallback(providerURL, "c3", binding)
+	w = s.request("POST", "/auth/exchange", map[string]string{"code": back.Query().Get("code"), "code_verifier": testVerifier}, "")
+	expectStatus(t, w, http.StatusOK)
+	restored, err := s.users.GetWithID(me.ID)
+	if err != nil || restored.DeletedAt != nil {
+		t.Fatalf("after restoring %+v %v", restored, err)
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"pdserver/pkg/mailer"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// checkPassword - Authenticate a local sign in behind the lockout.
+// Only wrong passwords count as failures, deleted and suspended accounts still knew theirs.
+// The lockout is reset once the whole sign in succeeded, see login and CompleteTwoFactorLogin.
+func (h *Handler) checkPassword(ctx *gin.Context, email string, password string) (*model.User, error) {
+	attempt, err := h.reserveAttempt(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	user, err := h.UserAPIService.Authenticate(email, password)
+	if errors.Is(err, api.ErrInvalidCredentials) {
+		h.failAttempt(ctx, attempt, email)
+		return nil, err
+	}
+	if releaseErr := h.LockoutAPIService.Release(attempt); releaseErr != nil {
+		log.Println(releaseErr.Error())
+	}
+	return user, err
+}
+
+// reserveAttempt - Reserve a sign in attempt of the account, blocked attempts get Retry-After
+func (h *Handler) reserveAttempt(ctx *gin.Context, account string) (*api.LoginAttempt, error) {
+	attempt, err := h.LockoutAPIService.Reserve(account, ctx.ClientIP())
+	if err != nil {
+		var blocked *api.LoginBlockedError
+		if errors.As(err, &blocked) {
+			ctx.Header("Retry-After", strconv.Itoa(seconds(blocked.RetryAfter)))
+			return nil, resolveError(err).WithDetails(gin.H{"retry_after": seconds(blocked.RetryAfter)})
+		}
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// failAttempt - Count a wrong password or second factor, the owner of email is told when it locked the account
+func (h *Handler) failAttempt(ctx *gin.Context, attempt *api.LoginAttempt, email string) {
+	locked, err := h.LockoutAPIService.Fail(attempt)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	if locked > 0 && email != "" {
+		h.notifyLocked(ctx, email, locked)
+	}
+}
+
+// resetLockout - Forget failures of the account once a sign in succeeded
+func (h *Handler) resetLockout(account string) {
+	if err := h.LockoutAPIService.Reset(account); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// lockoutAccount - Key the lockout counts the user by, the email password sign ins use when there is one
+func lockoutAccount(user *model.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	return "user:" + strconv.FormatUint(user.ID, 10)
+}
+
+// notifyLocked - Mail the owner of a locked account, nothing is sent for unknown addresses
+func (h *Handler) notifyLocked(ctx *gin.Context, email string, locked time.Duration) {
+	user, err := h.UserAPIService.Get(&model.User{Email: strings.TrimSpace(email)})
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println(err.Error())
+		}
+		return
+	}
+	data := map[string]string{
+		"ip":      ctx.ClientIP(),
+		"time":    time.Now().UTC().Format("2006-01-02 15:04 MST"),
+		"minutes": strconv.Itoa(int(locked.Minutes())),
+	}
+	if err := h.MailQueueAPIService.Send(user.Email, mailer.TemplateAccountLocked, acceptedLocale(ctx), data); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// SendUnlockCode - Mail a code that lifts the lockout of a registered address.
+// The response is the same whether or not the account exists.
+func (h *Handler) SendUnlockCode(ctx *gin.Context) {
+	var req model.UnlockCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	_, err := h.UserAPIService.Get(&model.User{Email: email})
+	switch {
+	case err == nil:
+		locale := acceptedLocale(ctx)
+		// Not awaited for the same reason as in ForgotPassword
+		go func() {
+			if err := h.OTPAPIService.SendUnlock(email, locale); err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		log.Println(err.Error())
+	}
+	ctx.JSON(http.StatusOK, "If the email is registered, an unlock code has been sent")
+}
+
+// UnlockAccount - Lift the lockout with the mailed code
+func (h *Handler) UnlockAccount(ctx *gin.Context) {
+	var req model.UnlockRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	ticket, err := h.OTPAPIService.Verify(api.OTPPurposeUnlock, req.Email, req.Code)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.OTPAPIService.ConsumeTicket(ticket); err != nil {
+		log.Println(err.Error())
+	}
+	if err := h.LockoutAPIService.Reset(req.Email); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully unlocked account")
+}
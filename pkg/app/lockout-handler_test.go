@@ -0,0 +1,53 @@
+package app
+
+import (
+	"net/http"
+	"pdserver/pkg/config"
+	"pdserver/pkg/mailer"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConcurrentWrongPasswordsAreBounded(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Lockout = config.LockoutConfig{Window: time.Hour, DelayAfter: 2, Delay: time.Hour, LockAfter: 3,
+			LockDuration: time.Hour, IPLockAfter: 100}
+	})
+	s.register("user@example.com", "planty", "password123")
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- s.login("user@example.com", "wrong-password").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	checked := 0
+	for code := range codes {
+		switch code {
+		case http.StatusUnauthorized:
+			checked++
+		case http.StatusTooManyRequests, http.StatusLocked:
+		default:
+			t.Fatalf("status %d", code)
+		}
+	}
+	if checked > 3 {
+		t.Fatalf("%d concurrent wrong passwords were checked", checked)
+	}
+	// Right passwords wait like everyone else, the unlock code lifts it
+	w := s.login("user@example.com", "password123")
+	if w.Code != http.StatusTooManyRequests && w.Code != http.StatusLocked {
+		t.Fatalf("status %d after the burst", w.Code)
+	}
+	expectStatus(t, s.request("POST", "/auth/unlock/mail", gin.H{"email": "user@example.com"}, ""), http.StatusOK)
+	code := s.awaitCode("user@example.com", mailer.TemplateAccountUnlock)
+	expectStatus(t, s.request("POST", "/auth/unlock", gin.H{"email": "user@example.com", "code": code}, ""), http.StatusOK)
+	expectStatus(t, s.login("user@example.com", "password123"), http.StatusOK)
+}
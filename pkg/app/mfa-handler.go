@@ -0,0 +1,168 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// login - Finish a password sign in, users with two-factor enabled get a challenge instead of tokens
+func (h *Handler) login(ctx *gin.Context, user *model.User) {
+	if h.challenged(ctx, user.ID) {
+		return
+	}
+	token, err := h.Authenticate(ctx, user.ID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	h.resetLockout(lockoutAccount(user))
+	ctx.JSON(http.StatusOK, model.LoginResponse{Token: *token, User: *user})
+}
+
+// challenged - Answer with a challenge when the user has two-factor enabled, or with the error checking it.
+// False when the sign in can go on without a second factor.
+func (h *Handler) challenged(ctx *gin.Context, userID uint64) bool {
+	enabled, err := h.TwoFactorAPIService.Enabled(userID)
+	if err != nil {
+		ctx.Error(err)
+		return true
+	}
+	if !enabled {
+		return false
+	}
+	challenge, err := h.TwoFactorAPIService.Challenge(userID)
+	if err != nil {
+		ctx.Error(err)
+		return true
+	}
+	ctx.JSON(http.StatusOK, challenge)
+	return true
+}
+
+// CompleteTwoFactorLogin - Trade the challenge of a sign in and a TOTP or recovery code for tokens.
+// Wrong codes count as failed sign ins of the account, a new challenge per password does not start over.
+func (h *Handler) CompleteTwoFactorLogin(ctx *gin.Context) {
+	var req model.MFALoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	userID, err := h.TwoFactorAPIService.ChallengeUser(req.MFAToken)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	user, err := h.UserAPIService.GetWithID(userID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	attempt, err := h.reserveAttempt(ctx, lockoutAccount(user))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	_, err = h.TwoFactorAPIService.CompleteChallenge(req.MFAToken, req.Code)
+	if errors.Is(err, api.ErrInvalidTwoFactorCode) || errors.Is(err, api.ErrTooManyAttempts) {
+		h.failAttempt(ctx, attempt, user.Email)
+		ctx.Error(err)
+		return
+	}
+	if releaseErr := h.LockoutAPIService.Release(attempt); releaseErr != nil {
+		log.Println(releaseErr.Error())
+	}
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	// The account may have changed since the password was checked
+	switch {
+	case user.DeletedAt != nil:
+		ctx.Error(api.ErrAccountDeleted)
+		return
+	case user.SuspendedAt != nil:
+		ctx.Error(api.ErrAccountSuspended)
+		return
+	}
+	token, err := h.Authenticate(ctx, user.ID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	h.resetLockout(lockoutAccount(user))
+	ctx.JSON(http.StatusOK, model.LoginResponse{Token: *token, User: *user})
+}
+
+func (h *Handler) TwoFactorStatus(ctx *gin.Context) {
+	status, err := h.TwoFactorAPIService.Status(TokenMetaData(ctx).UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
+
+// EnrollTwoFactor - Start enrollment with a new secret, two-factor is enabled once a code confirms it
+func (h *Handler) EnrollTwoFactor(ctx *gin.Context) {
+	user, err := h.UserAPIService.GetWithID(TokenMetaData(ctx).UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	enrollment, err := h.TwoFactorAPIService.Enroll(user)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmTwoFactor - Enable two-factor with a code of the enrolled secret, the recovery codes are only shown here
+func (h *Handler) ConfirmTwoFactor(ctx *gin.Context) {
+	var req model.TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	codes, err := h.TwoFactorAPIService.Confirm(TokenMetaData(ctx).UserID, req.Code)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, model.RecoveryCodes{Codes: codes})
+}
+
+// DisableTwoFactor - Turn two-factor off, takes a TOTP or recovery code
+func (h *Handler) DisableTwoFactor(ctx *gin.Context) {
+	var req model.TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	if err := h.TwoFactorAPIService.Disable(TokenMetaData(ctx).UserID, req.Code); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Two-factor authentication disabled")
+}
+
+// RegenerateRecoveryCodes - Replace all recovery codes, takes a TOTP or recovery code
+func (h *Handler) RegenerateRecoveryCodes(ctx *gin.Context) {
+	var req model.TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	codes, err := h.TwoFactorAPIService.RegenerateRecoveryCodes(TokenMetaData(ctx).UserID, req.Code)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, model.RecoveryCodes{Codes: codes})
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+)
+
+// enableTwoFactor - Enroll and confirm an authenticator with the code of the current period, returns its secret
+func (s *testServer) enableTwoFactor(accessToken string) (string, []string) {
+	s.t.Helper()
+	w := s.request("POST", "/users/me/2fa", nil, accessToken)
+	expectStatus(s.t, w, http.StatusOK)
+	var enrollment model.TwoFactorEnrollment
+	decode(s.t, w, &enrollment)
+	w = s.request("POST", "/users/me/2fa/confirm", gin.H{"code": totpCode(s.t, enrollment.Secret, 0)}, accessToken)
+	expectStatus(s.t, w, http.StatusOK)
+	var recovery model.RecoveryCodes
+	decode(s.t, w, &recovery)
+	return enrollment.Secret, recovery.Codes
+}
+
+// totpCode - Code of the authenticator the given number of periods from now, one period either way is accepted
+func totpCode(t *testing.T, secret string, periods int) string {
+	t.Helper()
+	code, err := totp.GenerateCode(secret, time.Now().Add(time.Duration(periods)*30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// expectChallenge - Sign in answered with a two-factor challenge instead of tokens
+func expectChallenge(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	expectStatus(t, w, http.StatusOK)
+	var challenge model.MFAChallenge
+	decode(t, w, &challenge)
+	if !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("no challenge in %s", w.Body.String())
+	}
+	return challenge.MFAToken
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	secret, recovery := s.enableTwoFactor(res.Token.AccessToken)
+
+	challenge := expectChallenge(t, s.login("user@example.com", "password123"))
+	// The code that confirmed the authenticator cannot be used again
+	expectError(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, 0)}, ""),
+		http.StatusUnauthorized, "invalid_two_factor_code")
+	w := s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, 1)}, "")
+	expectStatus(t, w, http.StatusOK)
+	var login model.LoginResponse
+	decode(t, w, &login)
+	if login.Token.AccessToken == "" {
+		t.Fatalf("no tokens in %s", w.Body.String())
+	}
+	expectError(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, -1)}, ""),
+		http.StatusUnauthorized, "invalid_mfa_challenge")
+
+	// Neither codes nor recovery codes are accepted twice
+	challenge = expectChallenge(t, s.login("user@example.com", "password123"))
+	expectError(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, 1)}, ""),
+		http.StatusUnauthorized, "invalid_two_factor_code")
+	expectStatus(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": recovery[0]}, ""), http.StatusOK)
+	challenge = expectChallenge(t, s.login("user@example.com", "password123"))
+	expectError(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": recovery[0]}, ""),
+		http.StatusUnauthorized, "invalid_two_factor_code")
+}
+
+func TestWrongSecondFactorLocksAccount(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Lockout = config.LockoutConfig{Window: time.Hour, DelayAfter: 100, Delay: time.Second, LockAfter: 3,
+			LockDuration: time.Hour, IPLockAfter: 100}
+	})
+	res := s.register("user@example.com", "planty", "password123")
+	secret, _ := s.enableTwoFactor(res.Token.AccessToken)
+	credential, err := s.users.GetTOTP(res.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(credential.Secret, secret) {
+		t.Fatalf("secret stored in plaintext: %s", credential.Secret)
+	}
+
+	// The right password does not start the count over, every challenge gets a wrong code
+	for i := 0; i < 3; i++ {
+		challenge := expectChallenge(t, s.login("user@example.com", "password123"))
+		expectError(t, s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, 10)}, ""),
+			http.StatusUnauthorized, "invalid_two_factor_code")
+	}
+	expectStatus(t, s.login("user@example.com", "password123"), http.StatusLocked)
+}
+
+func TestExchangeCodeNeedsSecondFactor(t *testing.T) {
+	s := newTestServer(t)
+	for _, code := range []string{"c1", "c2"} {
+		s.oauth.Register(code, model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	}
+	token := s.oauthSignIn("naver", "c1")
+	secret, _ := s.enableTwoFactor(token.AccessToken)
+
+	// Signing in with the provider again is a first factor like a password
+	handoff := s.oauthCode("naver", "c2")
+	w := s.request("POST", "/auth/exchange", gin.H{"code": handoff, "code_verifier": testVerifier}, "")
+	if decodeToken(t, w).AccessToken != "" {
+		t.Fatalf("exchange issued tokens: %s", w.Body.String())
+	}
+	challenge := expectChallenge(t, w)
+	w = s.request("POST", "/auth/2fa", gin.H{"mfa_token": challenge, "code": totpCode(t, secret, 1)}, "")
+	expectStatus(t, w, http.StatusOK)
+	var login model.LoginResponse
+	decode(t, w, &login)
+	if login.Token.AccessToken == "" || login.User.Email != "n@example.com" {
+		t.Fatalf("signed in as %s", w.Body.String())
+	}
+}
+
+func decodeToken(t *testing.T, w *httptest.ResponseRecorder) model.Token {
+	t.Helper()
+	var token model.Token
+	decode(t, w, &token)
+	return token
+}
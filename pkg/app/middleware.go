@@ -0,0 +1,190 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	tokenMetaDataKey = "token_meta_data"
+	// Largest body RateLimit reads for the email, the throttled routes only take small JSON
+	maxRateLimitedBody = 64 << 10
+)
+
+// ValidateTokenMiddleware - Reject requests without a live access token session.
+// On success the token meta data is available to handlers through TokenMetaData.
+func (h *Handler) ValidateTokenMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		accessToken, err := h.ExtractAccessToken(ctx.Request)
+		if err != nil {
+			abort(ctx, apperror.New(apperror.CodeUnauthorized, http.StatusUnauthorized, err.Error()))
+			return
+		}
+		tmd, err := h.TokenAPIService.Validate(accessToken)
+		if err != nil {
+			abort(ctx, err)
+			return
+		}
+		if err := h.TokenAPIService.TouchSession(tmd.FamilyID); err != nil && !errors.Is(err, api.ErrSessionNotFound) {
+			log.Println(err.Error())
+		}
+		ctx.Set(tokenMetaDataKey, tmd)
+		ctx.Next()
+	}
+}
+
+// RequireRole - Reject callers holding none of roles, use after ValidateTokenMiddleware
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		for _, required := range roles {
+			if hasRole(TokenMetaData(ctx).Roles, required) {
+				ctx.Next()
+				return
+			}
+		}
+		abort(ctx, apperror.New(apperror.CodeForbidden, http.StatusForbidden, "Missing required role"))
+	}
+}
+
+// RequirePermission - Reject callers whose roles don't grant permission, use after ValidateTokenMiddleware
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		for _, granted := range TokenMetaData(ctx).Permissions {
+			if granted == permission {
+				ctx.Next()
+				return
+			}
+		}
+		abort(ctx, apperror.New(apperror.CodeForbidden, http.StatusForbidden, "Missing permission "+permission))
+	}
+}
+
+// TokenMetaData - Token of the caller, set by ValidateTokenMiddleware
+func TokenMetaData(ctx *gin.Context) *model.TokenMetaData {
+	val, ok := ctx.Get(tokenMetaDataKey)
+	if !ok {
+		return nil
+	}
+	tmd, _ := val.(*model.TokenMetaData)
+	return tmd
+}
+
+// RateLimit - Throttle route by client IP, by the email the request is about and by the caller's account.
+// The email is read from ?email= or the JSON body, the account is only known after ValidateTokenMiddleware.
+// Requests are let through when the limiter fails, sign in should not depend on it.
+func (h *Handler) RateLimit(route string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		email, err := requestEmail(ctx)
+		if err != nil {
+			abort(ctx, err)
+			return
+		}
+		keys := map[string]string{api.RateLimitByIP: ctx.ClientIP(), api.RateLimitByEmail: email}
+		if tmd := TokenMetaData(ctx); tmd != nil {
+			keys[api.RateLimitByAccount] = strconv.FormatUint(tmd.UserID, 10)
+		}
+		var tightest *api.RateLimit
+		for by, key := range keys {
+			limit, err := h.RateLimitAPIService.Allow(route, by, key)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if limit != nil && (tightest == nil || tighter(limit, tightest)) {
+				tightest = limit
+			}
+		}
+		if tightest == nil {
+			ctx.Next()
+			return
+		}
+		reset := tightest.Reset
+		if !tightest.Allowed {
+			reset = tightest.RetryAfter
+		}
+		ctx.Header("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		ctx.Header("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		ctx.Header("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+		if !tightest.Allowed {
+			ctx.Header("Retry-After", strconv.Itoa(seconds(tightest.RetryAfter)))
+			abort(ctx, errRateLimited.WithDetails(gin.H{"retry_after": seconds(tightest.RetryAfter)}))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// tighter - Rejections first, the one lasting longest, then the limit with the fewest requests left
+func tighter(a *api.RateLimit, b *api.RateLimit) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+// seconds - Whole seconds rounded up, at least 1
+func seconds(d time.Duration) int {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// requestEmail - Lower cased ?email= or email field of a JSON body, the body is left for the handler to bind.
+// Bodies over maxRateLimitedBody are refused before they are read into memory.
+func requestEmail(ctx *gin.Context) (string, error) {
+	email := ctx.Query("email")
+	if email == "" && ctx.ContentType() == binding.MIMEJSON && ctx.Request.Body != nil {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxRateLimitedBody))
+		ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil && len(body) == maxRateLimitedBody {
+			return "", apperror.New(apperror.CodeRequestTooLarge, http.StatusRequestEntityTooLarge, "Request body is too large")
+		}
+		if err != nil {
+			return "", nil
+		}
+		var req struct {
+			Email string `json:"email"`
+		}
+		if json.Unmarshal(body, &req) == nil {
+			email = req.Email
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(email)), nil
+}
+
+func (h *Handler) ExtractAccessToken(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	strArr := strings.Split(authorization, " ")
+	if len(strArr) != 2 {
+		return "", fmt.Errorf("Invalid authorization")
+	}
+	return strArr[1], nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
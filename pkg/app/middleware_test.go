@@ -0,0 +1,76 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pdserver/pkg/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginFrom - Failed sign in sent through a proxy that claims the client is forwardedFor
+func (s *testServer) loginFrom(forwardedFor string, email string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	body, _ := json.Marshal(gin.H{"email": email, "password": "wrong-password"})
+	req := httptest.NewRequest("POST", "/auth/local", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	w := httptest.NewRecorder()
+	s.handler.Engin.ServeHTTP(w, req)
+	return w
+}
+
+func limitLoginPerIP(cfg *config.Config) {
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Login = config.RateLimitPolicy{Window: time.Hour, PerIP: 2}
+	cfg.Lockout.DelayAfter, cfg.Lockout.LockAfter, cfg.Lockout.IPLockAfter = 100, 100, 100
+}
+
+func TestForwardedForIsIgnoredByDefault(t *testing.T) {
+	s := newTestServer(t, limitLoginPerIP)
+	expectError(t, s.loginFrom("203.0.113.1", "a@example.com"), http.StatusUnauthorized, "invalid_credentials")
+	expectError(t, s.loginFrom("203.0.113.2", "b@example.com"), http.StatusUnauthorized, "invalid_credentials")
+	// A made up client IP per request does not get around the limit
+	w := s.loginFrom("203.0.113.3", "c@example.com")
+	expectError(t, w, http.StatusTooManyRequests, "rate_limited")
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After header")
+	}
+}
+
+func TestForwardedForOfTrustedProxy(t *testing.T) {
+	s := newTestServer(t, limitLoginPerIP)
+	// httptest requests come from 192.0.2.1
+	if err := s.handler.SetTrustedProxies([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		expectError(t, s.loginFrom("203.0.113.1", "a@example.com"), http.StatusUnauthorized, "invalid_credentials")
+	}
+	expectError(t, s.loginFrom("203.0.113.1", "a@example.com"), http.StatusTooManyRequests, "rate_limited")
+	expectError(t, s.loginFrom("203.0.113.2", "a@example.com"), http.StatusUnauthorized, "invalid_credentials")
+}
+
+func TestRegisterIsRateLimited(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Register = config.RateLimitPolicy{Window: time.Hour, PerEmail: 2}
+	})
+	body := gin.H{"email": "user@example.com", "nickname": "planty", "password": "password123", "ticket": "made-up"}
+	for i := 0; i < 2; i++ {
+		expectError(t, s.request("POST", "/auth/local/new", body, ""), http.StatusForbidden, "email_not_verified")
+	}
+	expectError(t, s.request("POST", "/auth/local/new", body, ""), http.StatusTooManyRequests, "rate_limited")
+}
+
+func TestRateLimitedBodyIsCapped(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) { cfg.RateLimit.Enabled = true })
+	body := gin.H{"email": "user@example.com", "password": strings.Repeat("a", maxRateLimitedBody)}
+	expectError(t, s.request("POST", "/auth/local", body, ""), http.StatusRequestEntityTooLarge, "request_too_large")
+	expectError(t, s.login("user@example.com", "password123"), http.StatusUnauthorized, "invalid_credentials")
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// ForgotPassword - Mail a reset code to a registered address.
+// The response is the same whether or not the account exists.
+func (h *Handler) ForgotPassword(ctx *gin.Context) {
+	var req model.ForgotPasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	_, err := h.UserAPIService.Get(&model.User{Email: email})
+	switch {
+	case err == nil:
+		locale := acceptedLocale(ctx)
+		// Queueing the code still takes measurable time for registered addresses only, so it is not awaited
+		go func() {
+			if err := h.OTPAPIService.SendPasswordReset(email, locale); err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		log.Println(err.Error())
+	}
+	ctx.JSON(http.StatusOK, "If the email is registered, a reset code has been sent")
+}
+
+// ResetPassword - Set a new password with the mailed code and log out every session
+func (h *Handler) ResetPassword(ctx *gin.Context) {
+	var req model.ResetPasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	ticket, err := h.OTPAPIService.Verify(api.OTPPurposeReset, email, req.Code)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.OTPAPIService.ConsumeTicket(ticket); err != nil {
+		log.Println(err.Error())
+	}
+	user, err := h.UserAPIService.Get(&model.User{Email: email})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctx.Error(api.ErrInvalidCode)
+		return
+	}
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.UserAPIService.SetPassword(user.ID, req.NewPassword); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.LockoutAPIService.Reset(email); err != nil {
+		log.Println(err.Error())
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(user.ID, ""); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully reset password")
+}
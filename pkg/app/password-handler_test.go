@@ -0,0 +1,40 @@
+package app
+
+import (
+	"net/http"
+	"pdserver/pkg/mailer"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// awaitCode - Code of a mail sent in the background, as forgot password and unlock do
+func (s *testServer) awaitCode(email string, template string) string {
+	s.t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if mail, ok := s.mail.Last(email); ok && mail.Template == template {
+			return mail.Data["code"]
+		}
+	}
+	s.t.Fatalf("no %s mail to %s", template, email)
+	return ""
+}
+
+func TestResetPassword(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	expectStatus(t, s.request("POST", "/auth/password/forgot", gin.H{"email": "user@example.com"}, ""), http.StatusOK)
+	code := s.awaitCode("user@example.com", mailer.TemplatePasswordReset)
+
+	// A reset code cannot be traded for a general verification ticket
+	expectError(t, s.request("POST", "/auth/code", gin.H{"email": "user@example.com", "code": code}, ""),
+		http.StatusUnauthorized, "code_expired")
+	expectError(t, s.request("POST", "/auth/unlock", gin.H{"email": "user@example.com", "code": code}, ""),
+		http.StatusUnauthorized, "code_expired")
+
+	expectStatus(t, s.request("POST", "/auth/password/reset",
+		gin.H{"email": "user@example.com", "code": code, "new_password": "newpassword1"}, ""), http.StatusOK)
+	expectError(t, s.request("GET", "/users/me", nil, res.Token.AccessToken), http.StatusUnauthorized, "token_revoked")
+	expectStatus(t, s.login("user@example.com", "newpassword1"), http.StatusOK)
+}
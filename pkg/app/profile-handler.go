@@ -0,0 +1,187 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/apperror"
+	"pdserver/pkg/mailer"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpdateProfile - Change name, nickname or birth of the caller
+func (h *Handler) UpdateProfile(ctx *gin.Context) {
+	var update model.ProfileUpdate
+	if err := ctx.ShouldBindJSON(&update); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	userID := TokenMetaData(ctx).UserID
+	if update.Nickname != nil {
+		user, err := h.UserAPIService.GetWithID(userID)
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		if *update.Nickname != user.Nickname && !h.nicknameAvailable(ctx, *update.Nickname) {
+			return
+		}
+	}
+	user, err := h.UserAPIService.UpdateProfile(userID, &update)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, user)
+}
+
+// ChangePassword - Replace the password and log out every other session
+func (h *Handler) ChangePassword(ctx *gin.Context) {
+	var req model.PasswordChangeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	tmd := TokenMetaData(ctx)
+	user, err := h.UserAPIService.GetWithID(tmd.UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !h.reauthenticate(ctx, user, req.CurrentPassword, req.Ticket) {
+		return
+	}
+	if err := h.UserAPIService.SetPassword(user.ID, req.NewPassword); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(user.ID, tmd.FamilyID); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully changed password")
+}
+
+// SendEmailChangeCode - Mail a verification code to the address the caller wants to switch to
+func (h *Handler) SendEmailChangeCode(ctx *gin.Context) {
+	var req model.EmailChangeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	if !h.emailAvailable(ctx, req.Email) {
+		return
+	}
+	if err := h.OTPAPIService.SendEmail(req.Email, acceptedLocale(ctx)); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully sent email")
+}
+
+// ChangeEmail - Switch to the new address once its ticket proves the caller owns it.
+// Like ChangePassword it needs the current password and logs out every other session,
+// the old address is told so the owner notices a stolen token taking over the account.
+func (h *Handler) ChangeEmail(ctx *gin.Context) {
+	var req model.EmailChangeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(apperror.Invalid(err))
+		return
+	}
+	tmd := TokenMetaData(ctx)
+	user, err := h.UserAPIService.GetWithID(tmd.UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !h.emailAvailable(ctx, req.Email) {
+		return
+	}
+	// Checked first so a wrong new ticket doesn't use up the one for the current email
+	if err := h.OTPAPIService.CheckTicket(req.Ticket, api.OTPPurposeVerify, req.Email); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !h.reauthenticate(ctx, user, req.CurrentPassword, req.CurrentTicket) {
+		return
+	}
+	if err := h.OTPAPIService.RedeemTicket(req.Ticket, api.OTPPurposeVerify, req.Email); err != nil {
+		ctx.Error(err)
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if err := h.UserAPIService.ChangeEmail(user.ID, email); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(user.ID, tmd.FamilyID); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if user.Email != "" {
+		data := map[string]string{"email": email, "ip": ctx.ClientIP(), "time": time.Now().UTC().Format("2006-01-02 15:04 MST")}
+		if err := h.MailQueueAPIService.Send(user.Email, mailer.TemplateEmailChanged, acceptedLocale(ctx), data); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	user, err = h.UserAPIService.GetWithID(user.ID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, user)
+}
+
+// reauthenticate - Confirm the caller still knows the password, an access token alone must not
+// turn into a permanent takeover. Users who signed up with a provider and never set a password
+// prove they own the email with a ticket instead. Adds the error and returns false otherwise.
+func (h *Handler) reauthenticate(ctx *gin.Context, user *model.User, password string, ticket string) bool {
+	if user.Password == "" && password == "" {
+		if err := h.OTPAPIService.RedeemTicket(ticket, api.OTPPurposeVerify, user.Email); err != nil {
+			ctx.Error(err)
+			return false
+		}
+		return true
+	}
+	authed, err := h.UserAPIService.Authenticate(user.Email, password)
+	if err == nil && authed.ID != user.ID {
+		err = api.ErrInvalidCredentials
+	}
+	if err != nil {
+		ctx.Error(err)
+		return false
+	}
+	return true
+}
+
+// emailAvailable - Add the error and return false when email belongs to an account
+func (h *Handler) emailAvailable(ctx *gin.Context, email string) bool {
+	available, err := h.UserAPIService.Available(strings.TrimSpace(email), "email")
+	if err != nil {
+		ctx.Error(err)
+		return false
+	}
+	if !available {
+		ctx.Error(errEmailTaken)
+		return false
+	}
+	return true
+}
+
+// nicknameAvailable - Add the error and return false when nickname belongs to an account
+func (h *Handler) nicknameAvailable(ctx *gin.Context, nickname string) bool {
+	available, err := h.UserAPIService.Available(nickname, "nickname")
+	if err != nil {
+		ctx.Error(err)
+		return false
+	}
+	if !available {
+		ctx.Error(errNicknameTaken)
+		return false
+	}
+	return true
+}
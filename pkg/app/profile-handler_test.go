@@ -0,0 +1,98 @@
+package app
+
+import (
+	"net/http"
+	"pdserver/pkg/api/model"
+	"pdserver/pkg/mailer"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestChangePassword(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	other := s.login("user@example.com", "password123")
+	var otherLogin model.LoginResponse
+	decode(t, other, &otherLogin)
+
+	expectError(t, s.request("PUT", "/users/me/password", gin.H{"new_password": "newpassword1"}, res.Token.AccessToken),
+		http.StatusUnauthorized, "invalid_credentials")
+	expectError(t, s.request("PUT", "/users/me/password",
+		gin.H{"current_password": "wrong-password", "new_password": "newpassword1"}, res.Token.AccessToken),
+		http.StatusUnauthorized, "invalid_credentials")
+	expectStatus(t, s.request("PUT", "/users/me/password",
+		gin.H{"current_password": "password123", "new_password": "newpassword1"}, res.Token.AccessToken), http.StatusOK)
+
+	// Other sessions are logged out, the one that changed it stays
+	expectError(t, s.request("GET", "/users/me", nil, otherLogin.Token.AccessToken), http.StatusUnauthorized, "token_revoked")
+	expectStatus(t, s.request("GET", "/users/me", nil, res.Token.AccessToken), http.StatusOK)
+	expectError(t, s.login("user@example.com", "password123"), http.StatusUnauthorized, "invalid_credentials")
+	expectStatus(t, s.login("user@example.com", "newpassword1"), http.StatusOK)
+}
+
+func TestFirstPasswordNeedsEmailTicket(t *testing.T) {
+	s := newTestServer(t)
+	s.oauth.Register("code", model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	token := s.oauthSignIn("naver", "code")
+
+	// A leaked access token alone cannot add a password login
+	expectError(t, s.request("PUT", "/users/me/password", gin.H{"new_password": "password123"}, token.AccessToken),
+		http.StatusForbidden, "email_not_verified")
+
+	expectStatus(t, s.request("GET", "/users/me/mail", nil, token.AccessToken), http.StatusOK)
+	w := s.request("POST", "/auth/code", gin.H{"email": "n@example.com", "code": s.mailedCode("n@example.com")}, "")
+	expectStatus(t, w, http.StatusOK)
+	var verified model.VerificationResponse
+	decode(t, w, &verified)
+	expectStatus(t, s.request("PUT", "/users/me/password",
+		gin.H{"new_password": "password123", "ticket": verified.Ticket}, token.AccessToken), http.StatusOK)
+	expectStatus(t, s.login("n@example.com", "password123"), http.StatusOK)
+}
+
+func TestChangeEmail(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	other := s.login("user@example.com", "password123")
+	var otherLogin model.LoginResponse
+	decode(t, other, &otherLogin)
+
+	expectStatus(t, s.request("POST", "/users/me/email", gin.H{"email": "new@example.com"}, res.Token.AccessToken), http.StatusOK)
+	w := s.request("POST", "/auth/code", gin.H{"email": "new@example.com", "code": s.mailedCode("new@example.com")}, "")
+	expectStatus(t, w, http.StatusOK)
+	var verified model.VerificationResponse
+	decode(t, w, &verified)
+
+	// A stolen access token and a ticket for the attacker's address are not enough
+	body := gin.H{"email": "new@example.com", "ticket": verified.Ticket}
+	expectError(t, s.request("PUT", "/users/me/email", body, res.Token.AccessToken), http.StatusUnauthorized, "invalid_credentials")
+	body["current_password"] = "wrong-password"
+	expectError(t, s.request("PUT", "/users/me/email", body, res.Token.AccessToken), http.StatusUnauthorized, "invalid_credentials")
+	body["current_password"] = "password123"
+	expectStatus(t, s.request("PUT", "/users/me/email", body, res.Token.AccessToken), http.StatusOK)
+
+	notice, ok := s.mail.Last("user@example.com")
+	if !ok || notice.Template != mailer.TemplateEmailChanged || notice.Data["email"] != "new@example.com" {
+		t.Fatalf("old address got %+v", notice)
+	}
+	expectError(t, s.request("GET", "/users/me", nil, otherLogin.Token.AccessToken), http.StatusUnauthorized, "token_revoked")
+	expectStatus(t, s.request("GET", "/users/me", nil, res.Token.AccessToken), http.StatusOK)
+	expectStatus(t, s.login("new@example.com", "password123"), http.StatusOK)
+}
+
+func TestChangeEmailWithoutPassword(t *testing.T) {
+	s := newTestServer(t)
+	s.oauth.Register("code", model.OAuthProfile{ProviderUserID: "N1", User: model.User{Email: "n@example.com", Nickname: "naver"}})
+	token := s.oauthSignIn("naver", "code")
+	body := gin.H{"email": "new@example.com", "ticket": s.verifyEmail("new@example.com")}
+	expectError(t, s.request("PUT", "/users/me/email", body, token.AccessToken), http.StatusForbidden, "email_not_verified")
+
+	// The ticket for the new address was not used up by the refusal
+	expectStatus(t, s.request("GET", "/users/me/mail", nil, token.AccessToken), http.StatusOK)
+	w := s.request("POST", "/auth/code", gin.H{"email": "n@example.com", "code": s.mailedCode("n@example.com")}, "")
+	expectStatus(t, w, http.StatusOK)
+	var current model.VerificationResponse
+	decode(t, w, &current)
+	body["current_ticket"] = current.Ticket
+	expectStatus(t, s.request("PUT", "/users/me/email", body, token.AccessToken), http.StatusOK)
+}
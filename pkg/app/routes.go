@@ -1,21 +1,63 @@
 package app
 
+import (
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+)
+
 func (h *Handler) SetupRoutes() {
+	h.Engin.GET("/.well-known/jwks.json", h.JWKS)
 	auth := h.Engin.Group("/auth")
 	{
-		auth.POST("/local/new", h.LocalRegister)
-		auth.GET("/naver", h.NaverLogin)
-		auth.GET("/naver/callback", h.NaverCallback)
-		auth.POST("/local", h.LocalLogin)
+		auth.POST("/local/new", h.RateLimit(api.RateLimitRegister), h.LocalRegister)
+		auth.GET("/:provider", h.OAuthLogin)
+		auth.GET("/:provider/callback", h.OAuthCallback)
+		auth.POST("/:provider/callback", h.OAuthCallback)
+		auth.POST("/:provider/link", h.OAuthLink)
+		auth.POST("/exchange", h.RateLimit(api.RateLimitExchange), h.ExchangeCode)
+		auth.POST("/local", h.RateLimit(api.RateLimitLogin), h.LocalLogin)
+		auth.POST("/restore", h.RateLimit(api.RateLimitLogin), h.RestoreAccount)
+		auth.POST("/2fa", h.RateLimit(api.RateLimitCode), h.CompleteTwoFactorLogin)
+		auth.POST("/password/forgot", h.RateLimit(api.RateLimitMail), h.ForgotPassword)
+		auth.POST("/password/reset", h.RateLimit(api.RateLimitCode), h.ResetPassword)
+		auth.POST("/unlock/mail", h.RateLimit(api.RateLimitMail), h.SendUnlockCode)
+		auth.POST("/unlock", h.RateLimit(api.RateLimitCode), h.UnlockAccount)
 		auth.DELETE("", h.ValidateTokenMiddleware(), h.Logout)
-		auth.POST("/re", h.ValidateTokenMiddleware(), h.RefreshToken)
-		auth.GET("/mail", h.SendEmail)
-		auth.POST("/code", h.VerifyCode)
-		auth.GET("/nickname/available", h.Available)
+		auth.POST("/re", h.RateLimit(api.RateLimitRefresh), h.RefreshToken)
+		auth.GET("/mail", h.RateLimit(api.RateLimitMail), h.SendEmail)
+		auth.POST("/code", h.RateLimit(api.RateLimitCode), h.VerifyCode)
+		auth.GET("/nickname/available", h.RateLimit(api.RateLimitNickname), h.Available)
 	}
 	users := h.Engin.Group("/users")
 	{
 		users.GET("/user", h.ValidateTokenMiddleware(), h.GetUser)
-		users.DELETE("/user")
+		users.DELETE("/user", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitLogin), h.DeleteAccount)
+		users.GET("/me/mail", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitMail), h.SendAccountEmail)
+		users.GET("/me", h.ValidateTokenMiddleware(), h.GetMe)
+		users.PATCH("/me", h.ValidateTokenMiddleware(), h.UpdateProfile)
+		users.GET("/:id", h.ValidateTokenMiddleware(), h.GetPublicUser)
+		users.PUT("/me/password", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitLogin), h.ChangePassword)
+		users.POST("/me/email", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitMail), h.SendEmailChangeCode)
+		users.PUT("/me/email", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitCode), h.ChangeEmail)
+		users.GET("/me/sessions", h.ValidateTokenMiddleware(), h.ListSessions)
+		users.DELETE("/me/sessions", h.ValidateTokenMiddleware(), h.RevokeAllSessions)
+		users.DELETE("/me/sessions/:id", h.ValidateTokenMiddleware(), h.RevokeSession)
+		users.GET("/me/2fa", h.ValidateTokenMiddleware(), h.TwoFactorStatus)
+		users.POST("/me/2fa", h.ValidateTokenMiddleware(), h.EnrollTwoFactor)
+		users.POST("/me/2fa/confirm", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitCode), h.ConfirmTwoFactor)
+		users.DELETE("/me/2fa", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitCode), h.DisableTwoFactor)
+		users.POST("/me/2fa/recovery-codes", h.ValidateTokenMiddleware(), h.RateLimit(api.RateLimitCode), h.RegenerateRecoveryCodes)
+		users.GET("/me/identities", h.ValidateTokenMiddleware(), h.ListIdentities)
+		users.POST("/me/identities/:provider", h.ValidateTokenMiddleware(), h.LinkIdentity)
+		users.DELETE("/me/identities/:provider", h.ValidateTokenMiddleware(), h.UnlinkIdentity)
+	}
+	admin := h.Engin.Group("/admin", h.ValidateTokenMiddleware(), RequireRole(model.RoleAdmin, model.RoleModerator))
+	{
+		admin.GET("/users", RequirePermission(model.PermissionUsersRead), h.ListUsers)
+		admin.POST("/users/:id/suspension", RequirePermission(model.PermissionUsersSuspend), h.SuspendUser)
+		admin.DELETE("/users/:id/suspension", RequirePermission(model.PermissionUsersSuspend), h.UnsuspendUser)
+		admin.PUT("/users/:id/roles", RequirePermission(model.PermissionRolesWrite), h.SetUserRoles)
+		admin.GET("/mail", RequirePermission(model.PermissionMailRead), h.ListMail)
+		admin.GET("/mail/:id", RequirePermission(model.PermissionMailRead), h.GetMail)
 	}
 }
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net/http"
+	"pdserver/pkg/api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) ListSessions(ctx *gin.Context) {
+	tmd := TokenMetaData(ctx)
+	sessions, err := h.TokenAPIService.ListSessions(tmd.UserID)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == tmd.FamilyID
+	}
+	ctx.JSON(http.StatusOK, sessions)
+}
+
+func (h *Handler) RevokeSession(ctx *gin.Context) {
+	tmd := TokenMetaData(ctx)
+	err := h.TokenAPIService.RevokeSession(tmd.UserID, ctx.Param("id"))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully logged out session")
+}
+
+// RevokeAllSessions - Log out everywhere, ?except_current=true keeps the caller logged in
+func (h *Handler) RevokeAllSessions(ctx *gin.Context) {
+	tmd := TokenMetaData(ctx)
+	exceptID := ""
+	if ctx.Query("except_current") == "true" {
+		exceptID = tmd.FamilyID
+	}
+	if err := h.TokenAPIService.RevokeAllSessions(tmd.UserID, exceptID); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.JSON(http.StatusOK, "Successfully logged out everywhere")
+}
+
+// deviceInfo - Describe the client making the request
+func deviceInfo(ctx *gin.Context) model.DeviceInfo {
+	return model.DeviceInfo{
+		DeviceName: ctx.GetHeader("X-Device-Name"),
+		UserAgent:  ctx.Request.UserAgent(),
+		IP:         ctx.ClientIP(),
+	}
+}
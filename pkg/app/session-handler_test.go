@@ -0,0 +1,84 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pdserver/pkg/api"
+	"pdserver/pkg/api/model"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *testServer) refresh(refreshToken string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.request("POST", "/auth/re", gin.H{"refresh_token": refreshToken}, "")
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	s := newTestServer(t)
+	first := s.register("user@example.com", "planty", "password123").Token
+
+	w := s.refresh(first.RefreshToken)
+	expectStatus(t, w, http.StatusOK)
+	var second model.Token
+	decode(t, w, &second)
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("refresh returned the same tokens")
+	}
+	expectError(t, s.request("GET", "/users/me", nil, first.AccessToken), http.StatusUnauthorized, "token_revoked")
+	expectStatus(t, s.request("GET", "/users/me", nil, second.AccessToken), http.StatusOK)
+	expectStatus(t, s.refresh(second.RefreshToken), http.StatusOK)
+}
+
+func TestRefreshLoadsCurrentRoles(t *testing.T) {
+	s := newTestServer(t)
+	moderator := s.staff("mod@example.com", "moderator", model.RoleModerator)
+	user := s.register("user@example.com", "planty", "password123")
+	if err := s.users.SetRoles(moderator.User.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.refresh(moderator.Token.RefreshToken)
+	expectStatus(t, w, http.StatusOK)
+	var refreshed model.Token
+	decode(t, w, &refreshed)
+	expectError(t, s.request("POST", "/admin/users/"+strconv.FormatUint(user.User.ID, 10)+"/suspension", nil, refreshed.AccessToken),
+		http.StatusForbidden, "forbidden")
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	s := newTestServer(t)
+	stolen := s.register("user@example.com", "planty", "password123").Token
+	other := s.login("user@example.com", "password123")
+	expectStatus(t, other, http.StatusOK)
+	var otherLogin model.LoginResponse
+	decode(t, other, &otherLogin)
+
+	w := s.refresh(stolen.RefreshToken)
+	expectStatus(t, w, http.StatusOK)
+	var rotated model.Token
+	decode(t, w, &rotated)
+
+	// Replaying the rotated token logs out everything derived from that login
+	expectError(t, s.refresh(stolen.RefreshToken), http.StatusUnauthorized, "refresh_token_reused")
+	expectError(t, s.refresh(rotated.RefreshToken), http.StatusUnauthorized, "token_revoked")
+	expectError(t, s.request("GET", "/users/me", nil, rotated.AccessToken), http.StatusUnauthorized, "token_revoked")
+	if len(s.auditor.Events) != 1 || s.auditor.Events[0].Type != api.AuditRefreshTokenReuse {
+		t.Fatalf("audit events %+v", s.auditor.Events)
+	}
+
+	// Other logins are separate families
+	expectStatus(t, s.request("GET", "/users/me", nil, otherLogin.Token.AccessToken), http.StatusOK)
+	expectStatus(t, s.refresh(otherLogin.Token.RefreshToken), http.StatusOK)
+}
+
+func TestRefreshRejectsAccessToken(t *testing.T) {
+	s := newTestServer(t)
+	res := s.register("user@example.com", "planty", "password123")
+	w := s.refresh(res.Token.AccessToken)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pdserver/pkg/api/model"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/ko"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	entranslations "github.com/go-playground/validator/v10/translations/en"
+)
+
+const defaultLocale = "en"
+
+var translators = map[string]ut.Translator{}
+
+// Custom tags, the rules live in the model package
+var validations = map[string]func(string) bool{
+	"password":  model.ValidPassword,
+	"nickname":  model.ValidNickname,
+	"birthdate": model.ValidBirthDate,
+}
+
+// The validator has no Korean translations, every tag used by binding tags is listed here
+var messages = map[string]map[string]string{
+	"en": {
+		"required_without": "{0} is required when {1} is empty",
+		"password":         fmt.Sprintf("{0} must be at least %d characters with a letter and a digit", model.PasswordMinLength),
+		"nickname":         fmt.Sprintf("{0} must be %d to %d Hangul, latin letters, digits or _", model.NicknameMinLength, model.NicknameMaxLength),
+		"birthdate":        "{0} must be a past date in YYYY-MM-DD format",
+	},
+	"ko": {
+		"required":         "{0}은(는) 필수 항목입니다",
+		"required_without": "{0}은(는) {1}이(가) 없으면 필수 항목입니다",
+		"email":            "{0}은(는) 올바른 이메일 주소가 아닙니다",
+		"min":              "{0}은(는) {1}자 이상이어야 합니다",
+		"max":              "{0}은(는) {1}자 이하여야 합니다",
+		"len":              "{0}은(는) {1}자여야 합니다",
+		"numeric":          "{0}은(는) 숫자만 입력할 수 있습니다",
+		"oneof":            "{0}은(는) [{1}] 중 하나여야 합니다",
+		"password":         fmt.Sprintf("{0}은(는) 영문과 숫자를 포함해 %d자 이상이어야 합니다", model.PasswordMinLength),
+		"nickname":         fmt.Sprintf("{0}은(는) 한글, 영문, 숫자, _ 로 %d~%d자여야 합니다", model.NicknameMinLength, model.NicknameMaxLength),
+		"birthdate":        "{0}은(는) YYYY-MM-DD 형식의 지난 날짜여야 합니다",
+	},
+}
+
+var invalidTypeMessages = map[string]string{
+	"en": "{0} has the wrong type",
+	"ko": "{0}의 형식이 올바르지 않습니다",
+}
+
+// Registered on gin's validator once, binding tags are checked by ShouldBindJSON and ShouldBindQuery
+func init() {
+	if err := setupValidator(); err != nil {
+		panic(err)
+	}
+}
+
+func setupValidator() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("Unexpected validator engine")
+	}
+	// Report fields by the name clients send
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "form"} {
+			name := strings.SplitN(field.Tag.Get(tag), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name != "" {
+				return name
+			}
+		}
+		return field.Name
+	})
+	for tag, valid := range validations {
+		valid := valid
+		if err := v.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+			return valid(fl.Field().String())
+		}); err != nil {
+			return err
+		}
+	}
+	uni := ut.New(en.New(), en.New(), ko.New())
+	for locale, localeMessages := range messages {
+		trans, _ := uni.GetTranslator(locale)
+		if locale == "en" {
+			if err := entranslations.RegisterDefaultTranslations(v, trans); err != nil {
+				return err
+			}
+		}
+		for tag, message := range localeMessages {
+			if err := registerTranslation(v, trans, tag, message); err != nil {
+				return err
+			}
+		}
+		translators[locale] = trans
+	}
+	return nil
+}
+
+func registerTranslation(v *validator.Validate, trans ut.Translator, tag string, message string) error {
+	return v.RegisterTranslation(tag, trans, func(trans ut.Translator) error {
+		return trans.Add(tag, message, true)
+	}, func(trans ut.Translator, fe validator.FieldError) string {
+		param := fe.Param()
+		if tag == "required_without" {
+			param = jsonName(param)
+		}
+		translated, err := trans.T(tag, fe.Field(), param)
+		if err != nil {
+			return fe.Error()
+		}
+		return translated
+	})
+}
+
+// jsonName - Snake case of a struct field name, params of cross field tags are not renamed by the validator
+func jsonName(field string) string {
+	var name strings.Builder
+	for i, r := range field {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				name.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		name.WriteRune(r)
+	}
+	return name.String()
+}
+
+// validationDetails - Field errors of a failed bind in the caller's language, nil for other errors
+func validationDetails(ctx *gin.Context, err error) []model.FieldError {
+	locale := requestLocale(ctx)
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		details := make([]model.FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			details = append(details, model.FieldError{Field: fe.Field(), Rule: fe.Tag(), Message: fe.Translate(translators[locale])})
+		}
+		return details
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		message := strings.Replace(invalidTypeMessages[locale], "{0}", typeErr.Field, 1)
+		return []model.FieldError{{Field: typeErr.Field, Rule: "type", Message: message}}
+	}
+	return nil
+}
+
+// requestLocale - First supported language of Accept-Language
+func requestLocale(ctx *gin.Context) string {
+	if locale := acceptedLocale(ctx); locale != "" {
+		return locale
+	}
+	return defaultLocale
+}
+
+// acceptedLocale - Like requestLocale, empty when the client asks for no supported language
+func acceptedLocale(ctx *gin.Context) string {
+	for _, part := range strings.Split(ctx.GetHeader("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := translators[lang]; ok {
+			return lang
+		}
+	}
+	return ""
+}
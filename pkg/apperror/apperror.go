@@ -0,0 +1,154 @@
+package apperror
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+)
+
+// Code - Stable machine readable error code, clients branch on it instead of the message
+type Code string
+
+const (
+	CodeInvalidRequest     Code = "invalid_request"
+	CodeRequestTooLarge    Code = "request_too_large"
+	CodeInvalidRedirectURI Code = "invalid_redirect_uri"
+	CodeUnknownRole        Code = "unknown_role"
+
+	CodeUnauthorized         Code = "unauthorized"
+	CodeInvalidCredentials   Code = "invalid_credentials"
+	CodeTokenExpired         Code = "token_expired"
+	CodeTokenRevoked         Code = "token_revoked"
+	CodeTokenMalformed       Code = "token_malformed"
+	CodeRefreshTokenReused   Code = "refresh_token_reused"
+	CodeInvalidCode          Code = "invalid_code"
+	CodeCodeExpired          Code = "code_expired"
+	CodeInvalidAuthCode      Code = "invalid_auth_code"
+	CodeInvalidLinkTicket    Code = "invalid_link_ticket"
+	CodeInvalidTwoFactorCode Code = "invalid_two_factor_code"
+	CodeInvalidMFAChallenge  Code = "invalid_mfa_challenge"
+	CodeInvalidOAuthState    Code = "invalid_oauth_state"
+
+	CodeForbidden        Code = "forbidden"
+	CodeEmailNotVerified Code = "email_not_verified"
+	CodeAccountDeleted   Code = "account_deleted"
+	CodeAccountSuspended Code = "account_suspended"
+	CodeAccountLocked    Code = "account_locked"
+
+	CodeNotFound         Code = "not_found"
+	CodeUserNotFound     Code = "user_not_found"
+	CodeUnknownProvider  Code = "unknown_provider"
+	CodeIdentityNotFound Code = "identity_not_found"
+	CodeSessionNotFound  Code = "session_not_found"
+	CodeMailNotFound     Code = "mail_not_found"
+
+	CodeConflict             Code = "conflict"
+	CodeNicknameTaken        Code = "nickname_taken"
+	CodeEmailTaken           Code = "email_taken"
+	CodeIdentityInUse        Code = "identity_in_use"
+	CodeProviderLinked       Code = "provider_linked"
+	CodeLastLoginMethod      Code = "last_login_method"
+	CodeAccountExists        Code = "account_exists"
+	CodeAccountNotDeleted    Code = "account_not_deleted"
+	CodeTwoFactorEnabled     Code = "two_factor_enabled"
+	CodeTwoFactorNotEnabled  Code = "two_factor_not_enabled"
+	CodeTwoFactorNotEnrolled Code = "two_factor_not_enrolled"
+	CodeSelfAction           Code = "self_action"
+	CodeRateLimited          Code = "rate_limited"
+	CodeLoginDelayed         Code = "login_delayed"
+	CodeIPLocked             Code = "ip_locked"
+	CodeTooManyAttempts      Code = "too_many_attempts"
+	CodeInternal             Code = "internal_error"
+	CodeServiceUnavailable   Code = "service_unavailable"
+)
+
+// Error - Error with the code, status and message sent to the client.
+// Err is the cause, it is logged but never sent.
+type Error struct {
+	Code    Code
+	Status  int
+	Message string
+	Details interface{}
+	Err     error
+}
+
+func New(code Code, status int, message string) *Error {
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Code, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap - Copy of e caused by err
+func (e *Error) Wrap(err error) *Error {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// WithDetails - Copy of e carrying details for the client
+func (e *Error) WithDetails(details interface{}) *Error {
+	detailed := *e
+	detailed.Details = details
+	return &detailed
+}
+
+// Invalid - Request body or query could not be read
+func Invalid(err error) *Error {
+	return &Error{Code: CodeInvalidRequest, Status: http.StatusUnprocessableEntity, Message: "Invalid request", Err: err}
+}
+
+// InvalidMessage - Request was read but a value is not acceptable
+func InvalidMessage(message string) *Error {
+	return New(CodeInvalidRequest, http.StatusUnprocessableEntity, message)
+}
+
+// Internal - Unexpected failure, the cause is hidden from the client
+func Internal(err error) *Error {
+	return &Error{Code: CodeInternal, Status: http.StatusInternalServerError, Message: "Internal server error", Err: err}
+}
+
+// From - Error for any err, storage and token library errors are mapped to their codes.
+// Unknown errors become internal errors so their text doesn't reach the client.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, redis.Nil) {
+		return &Error{Code: CodeNotFound, Status: http.StatusNotFound, Message: "Resource not found", Err: err}
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return &Error{Code: CodeConflict, Status: http.StatusConflict, Message: "Resource already exists", Err: err}
+	}
+	var jwtErr *jwt.ValidationError
+	if errors.As(err, &jwtErr) {
+		if jwtErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return &Error{Code: CodeTokenExpired, Status: http.StatusUnauthorized, Message: "Token has expired", Err: err}
+		}
+		return &Error{Code: CodeTokenMalformed, Status: http.StatusUnauthorized, Message: "Token is malformed", Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return &Error{Code: CodeServiceUnavailable, Status: http.StatusServiceUnavailable, Message: "Service temporarily unavailable", Err: err}
+	}
+	return Internal(err)
+}
+
+const mysqlDuplicateEntry = 1062
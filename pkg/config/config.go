@@ -0,0 +1,526 @@
+package config
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config - Server configuration.
+// Values are resolved as defaults < YAML file < environment < command line flags.
+type Config struct {
+	Server    ServerConfig         `yaml:"server"`
+	Database  DatabaseConfig       `yaml:"database"`
+	Redis     RedisConfig          `yaml:"redis"`
+	JWT       JWTConfig            `yaml:"jwt"`
+	Password  PasswordConfig       `yaml:"password"`
+	Mail      MailConfig           `yaml:"mail"`
+	MailQueue MailQueueConfig      `yaml:"mail_queue"`
+	OTP       OTPConfig            `yaml:"otp"`
+	OAuth     OAuthProvidersConfig `yaml:"oauth"`
+	App       AppConfig            `yaml:"app"`
+	Account   AccountConfig        `yaml:"account"`
+	RateLimit RateLimitConfig      `yaml:"rate_limit"`
+	Lockout   LockoutConfig        `yaml:"lockout"`
+	TwoFactor TwoFactorConfig      `yaml:"two_factor"`
+}
+
+// ServerConfig - PublicURL is the address clients reach the server at, used to build callback links.
+// X-Forwarded-For is only believed from TrustedProxies, IPs or CIDRs of the load balancers in front
+// of the server. Without any the client IP is the peer address, which rate limits and lockouts count by.
+type ServerConfig struct {
+	Addr           string   `yaml:"addr"`
+	PublicURL      string   `yaml:"public_url"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type DatabaseConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Name     string `yaml:"name"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// JWTConfig - Token lifetimes and signing keys.
+// Secrets only verify HS256 tokens issued before signing moved to the key ring.
+// KeyEncryptionKey is the base64 of 32 random bytes, signing keys are encrypted with it in redis
+// and authenticator secrets in the database.
+type JWTConfig struct {
+	AccessSecret     string        `yaml:"access_secret"`
+	RefreshSecret    string        `yaml:"refresh_secret"`
+	AccessTTL        time.Duration `yaml:"access_ttl"`
+	RefreshTTL       time.Duration `yaml:"refresh_ttl"`
+	KeyRotation      time.Duration `yaml:"key_rotation"`
+	KeyPrepublish    time.Duration `yaml:"key_prepublish"`
+	KeyEncryptionKey string        `yaml:"key_encryption_key"`
+}
+
+type PasswordConfig struct {
+	Cost int `yaml:"cost"`
+}
+
+// Mail drivers, outbox writes .eml files for local development and log only prints the text
+const (
+	MailDriverSMTP   = "smtp"
+	MailDriverOutbox = "outbox"
+	MailDriverLog    = "log"
+)
+
+// MailConfig - Outgoing mail. TemplateDir overrides built in templates file by file,
+// Locale is used when the recipient's language has no template.
+type MailConfig struct {
+	Driver      string `yaml:"driver"`
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	From        string `yaml:"from"`
+	FromName    string `yaml:"from_name"`
+	OutboxDir   string `yaml:"outbox_dir"`
+	TemplateDir string `yaml:"template_dir"`
+	Locale      string `yaml:"locale"`
+}
+
+// MailQueueConfig - Mail is queued and sent by Workers in the background.
+// A failed send is retried after Backoff, doubled on every attempt up to MaxBackoff,
+// and dead-lettered after MaxAttempts. Jobs and idempotency keys of callers are kept for Retention.
+type MailQueueConfig struct {
+	Workers     int           `yaml:"workers"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	Retention   time.Duration `yaml:"retention"`
+}
+
+// OTPConfig - Email verification codes sent on sign up
+type OTPConfig struct {
+	CodeTTL     time.Duration `yaml:"code_ttl"`
+	TicketTTL   time.Duration `yaml:"ticket_ttl"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+// OAuthProvidersConfig - Sign in providers, a provider without client id is disabled
+type OAuthProvidersConfig struct {
+	Naver  OAuthConfig `yaml:"naver"`
+	Kakao  OAuthConfig `yaml:"kakao"`
+	Google OAuthConfig `yaml:"google"`
+	Apple  OAuthConfig `yaml:"apple"`
+}
+
+// OAuthConfig - RedirectURL defaults to <public url>/auth/<provider>/callback
+type OAuthConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+// AppConfig - Native app the OAuth callback hands off to.
+// RedirectURIs are the only places codes are sent, the first one is used when the app names none.
+type AppConfig struct {
+	RedirectURIs []string      `yaml:"redirect_uris"`
+	CodeTTL      time.Duration `yaml:"code_ttl"`
+}
+
+// AccountConfig - Deleted accounts can be restored for DeletionGrace, then they are purged
+type AccountConfig struct {
+	DeletionGrace time.Duration `yaml:"deletion_grace"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// RateLimitConfig - Throttling of routes that send mail, check secrets or create accounts and sessions
+type RateLimitConfig struct {
+	Enabled  bool            `yaml:"enabled"`
+	Login    RateLimitPolicy `yaml:"login"`
+	Mail     RateLimitPolicy `yaml:"mail"`
+	Code     RateLimitPolicy `yaml:"code"`
+	Nickname RateLimitPolicy `yaml:"nickname"`
+	Register RateLimitPolicy `yaml:"register"`
+	Exchange RateLimitPolicy `yaml:"exchange"`
+	Refresh  RateLimitPolicy `yaml:"refresh"`
+}
+
+// RateLimitPolicy - Requests allowed within a sliding Window per client IP, per email and per account.
+// A limit of 0 leaves that key unlimited.
+type RateLimitPolicy struct {
+	Window     time.Duration `yaml:"window"`
+	PerIP      int           `yaml:"per_ip"`
+	PerEmail   int           `yaml:"per_email"`
+	PerAccount int           `yaml:"per_account"`
+}
+
+// LockoutConfig - Failed sign ins are counted per account and per IP for Window.
+// From DelayAfter failures the next attempt has to wait Delay, doubled on every further failure.
+// At LockAfter failures the account is locked for LockDuration, at IPLockAfter the IP is.
+type LockoutConfig struct {
+	Window       time.Duration `yaml:"window"`
+	DelayAfter   int           `yaml:"delay_after"`
+	Delay        time.Duration `yaml:"delay"`
+	LockAfter    int           `yaml:"lock_after"`
+	LockDuration time.Duration `yaml:"lock_duration"`
+	IPLockAfter  int           `yaml:"ip_lock_after"`
+}
+
+// TwoFactorConfig - Authenticator app sign in. Issuer is the name apps show for the account,
+// a sign in challenge has to be completed within ChallengeTTL and MaxAttempts codes.
+type TwoFactorConfig struct {
+	Issuer        string        `yaml:"issuer"`
+	ChallengeTTL  time.Duration `yaml:"challenge_ttl"`
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RecoveryCodes int           `yaml:"recovery_codes"`
+}
+
+// Default - Configuration used when nothing else is given
+func Default() *Config {
+	return &Config{
+		Server:   ServerConfig{Addr: ":8080", PublicURL: "http://localhost:8080"},
+		Database: DatabaseConfig{Port: "3306"},
+		Redis:    RedisConfig{Addr: "localhost:6379"},
+		JWT: JWTConfig{AccessTTL: time.Hour, RefreshTTL: 24 * time.Hour,
+			KeyRotation: 30 * 24 * time.Hour, KeyPrepublish: 24 * time.Hour},
+		Password: PasswordConfig{Cost: 10},
+		Mail: MailConfig{Driver: MailDriverSMTP, Host: "smtp.gmail.com", Port: 587, From: "support@plantdoctor.com",
+			FromName: "PlantDoctor", OutboxDir: "mail-outbox", Locale: "ko"},
+		MailQueue: MailQueueConfig{Workers: 4, MaxAttempts: 6, Backoff: 30 * time.Second, MaxBackoff: time.Hour,
+			Retention: 7 * 24 * time.Hour},
+		OTP: OTPConfig{CodeTTL: 3 * time.Minute, TicketTTL: 30 * time.Minute, MaxAttempts: 5},
+		App: AppConfig{RedirectURIs: []string{"plantdoctor://"}, CodeTTL: time.Minute},
+		RateLimit: RateLimitConfig{
+			Enabled:  true,
+			Login:    RateLimitPolicy{Window: 15 * time.Minute, PerIP: 50, PerEmail: 10, PerAccount: 10},
+			Mail:     RateLimitPolicy{Window: time.Hour, PerIP: 20, PerEmail: 5, PerAccount: 5},
+			Code:     RateLimitPolicy{Window: 15 * time.Minute, PerIP: 30, PerEmail: 10, PerAccount: 10},
+			Nickname: RateLimitPolicy{Window: time.Minute, PerIP: 30, PerAccount: 30},
+			Register: RateLimitPolicy{Window: time.Hour, PerIP: 10, PerEmail: 3},
+			Exchange: RateLimitPolicy{Window: 15 * time.Minute, PerIP: 30},
+			Refresh:  RateLimitPolicy{Window: 15 * time.Minute, PerIP: 120},
+		},
+		Lockout: LockoutConfig{Window: 15 * time.Minute, DelayAfter: 3, Delay: time.Second, LockAfter: 10,
+			LockDuration: 30 * time.Minute, IPLockAfter: 100},
+		TwoFactor: TwoFactorConfig{Issuer: "PlantDoctor", ChallengeTTL: 5 * time.Minute, MaxAttempts: 5, RecoveryCodes: 10},
+		Account:   AccountConfig{DeletionGrace: 30 * 24 * time.Hour, PurgeInterval: time.Hour},
+	}
+}
+
+// Load - Build configuration from file, environment and command line arguments
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	bindings := cfg.bindings()
+
+	fs := flag.NewFlagSet("pdserver", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "Path to YAML configuration file")
+	for _, b := range bindings {
+		fs.String(b.flag, "", fmt.Sprintf("%s (env %s)", b.usage, b.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range bindings {
+		if val := os.Getenv(b.env); val != "" {
+			if err := b.set(val); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", b.env, err.Error())
+			}
+		}
+	}
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, b := range bindings {
+			if b.flag == f.Name && flagErr == nil {
+				if err := b.set(f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("Invalid -%s: %s", b.flag, err.Error())
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate - Refuse configurations the server cannot safely run with
+func (c *Config) Validate() error {
+	required := []struct {
+		name string
+		val  string
+	}{
+		{"server addr", c.Server.Addr},
+		{"database user", c.Database.User},
+		{"database host", c.Database.Host},
+		{"database name", c.Database.Name},
+		{"redis addr", c.Redis.Addr},
+		{"jwt access secret", c.JWT.AccessSecret},
+		{"jwt refresh secret", c.JWT.RefreshSecret},
+		{"jwt key encryption key", c.JWT.KeyEncryptionKey},
+	}
+	for _, field := range required {
+		if field.val == "" {
+			return fmt.Errorf("Missing configuration: %s", field.name)
+		}
+	}
+	if c.JWT.AccessSecret == c.JWT.RefreshSecret {
+		return fmt.Errorf("Access and refresh secrets must differ")
+	}
+	if c.JWT.AccessTTL <= 0 || c.JWT.RefreshTTL <= 0 {
+		return fmt.Errorf("Token lifetimes must be positive")
+	}
+	if c.JWT.KeyPrepublish < 0 || c.JWT.KeyRotation <= c.JWT.KeyPrepublish {
+		return fmt.Errorf("Key rotation must be longer than key prepublish")
+	}
+	if kek, err := base64.StdEncoding.DecodeString(c.JWT.KeyEncryptionKey); err != nil || len(kek) != 32 {
+		return fmt.Errorf("Key encryption key must be 32 bytes in base64")
+	}
+	if c.Password.Cost < 4 || c.Password.Cost > 31 {
+		return fmt.Errorf("Password cost must be between 4 and 31")
+	}
+	switch c.Mail.Driver {
+	case MailDriverSMTP:
+		if c.Mail.Host == "" || c.Mail.Port <= 0 {
+			return fmt.Errorf("Mail host and port are required for the smtp driver")
+		}
+	case MailDriverOutbox:
+		if c.Mail.OutboxDir == "" {
+			return fmt.Errorf("Missing configuration: mail outbox dir")
+		}
+	case MailDriverLog:
+	default:
+		return fmt.Errorf("Unknown mail driver: %s", c.Mail.Driver)
+	}
+	if c.MailQueue.Workers <= 0 || c.MailQueue.MaxAttempts <= 0 {
+		return fmt.Errorf("Mail queue workers and max attempts must be positive")
+	}
+	if c.MailQueue.Backoff <= 0 || c.MailQueue.MaxBackoff < c.MailQueue.Backoff || c.MailQueue.Retention <= 0 {
+		return fmt.Errorf("Mail queue backoff and retention must be positive, max backoff at least backoff")
+	}
+	if c.OTP.CodeTTL <= 0 || c.OTP.TicketTTL <= 0 || c.OTP.MaxAttempts <= 0 {
+		return fmt.Errorf("OTP code ttl, ticket ttl and max attempts must be positive")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("Invalid trusted proxy: %s", proxy)
+		}
+	}
+	if len(c.App.RedirectURIs) == 0 {
+		return fmt.Errorf("Missing configuration: app redirect uris")
+	}
+	for _, uri := range c.App.RedirectURIs {
+		if parsed, err := url.Parse(uri); err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("Invalid app redirect uri: %s", uri)
+		}
+	}
+	if c.App.CodeTTL <= 0 {
+		return fmt.Errorf("App code ttl must be positive")
+	}
+	if c.Account.DeletionGrace <= 0 || c.Account.PurgeInterval <= 0 {
+		return fmt.Errorf("Account deletion grace and purge interval must be positive")
+	}
+	if c.Lockout.Window <= 0 || c.Lockout.Delay <= 0 || c.Lockout.LockDuration <= 0 {
+		return fmt.Errorf("Lockout window, delay and lock duration must be positive")
+	}
+	if c.Lockout.DelayAfter <= 0 || c.Lockout.LockAfter <= c.Lockout.DelayAfter || c.Lockout.IPLockAfter <= 0 {
+		return fmt.Errorf("Lockout thresholds must be positive with lock after greater than delay after")
+	}
+	if c.TwoFactor.Issuer == "" || strings.Contains(c.TwoFactor.Issuer, ":") {
+		return fmt.Errorf("Two factor issuer must be set and cannot contain a colon")
+	}
+	if c.TwoFactor.ChallengeTTL <= 0 || c.TwoFactor.MaxAttempts <= 0 || c.TwoFactor.RecoveryCodes <= 0 {
+		return fmt.Errorf("Two factor challenge ttl, max attempts and recovery codes must be positive")
+	}
+	for name, policy := range map[string]RateLimitPolicy{"login": c.RateLimit.Login, "mail": c.RateLimit.Mail,
+		"code": c.RateLimit.Code, "nickname": c.RateLimit.Nickname, "register": c.RateLimit.Register,
+		"exchange": c.RateLimit.Exchange, "refresh": c.RateLimit.Refresh} {
+		if policy.Window <= 0 || policy.PerIP < 0 || policy.PerEmail < 0 || policy.PerAccount < 0 {
+			return fmt.Errorf("Rate limit %s needs a positive window and limits of at least 0", name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, c)
+}
+
+type binding struct {
+	env   string
+	flag  string
+	usage string
+	set   func(string) error
+}
+
+func (c *Config) bindings() []binding {
+	return []binding{
+		{"SERVER_ADDR", "addr", "HTTP listen address", setString(&c.Server.Addr)},
+		{"PUBLIC_URL", "public-url", "URL clients reach the server at", setString(&c.Server.PublicURL)},
+		{"TRUSTED_PROXIES", "trusted-proxies", "Comma separated proxy IPs or CIDRs whose X-Forwarded-For is believed", setStrings(&c.Server.TrustedProxies)},
+		{"DB_USER", "db-user", "MySQL user", setString(&c.Database.User)},
+		{"DB_PASSWORD", "db-password", "MySQL password", setString(&c.Database.Password)},
+		{"DB_HOST", "db-host", "MySQL host", setString(&c.Database.Host)},
+		{"DB_PORT", "db-port", "MySQL port", setString(&c.Database.Port)},
+		{"DB_NAME", "db-name", "MySQL database name", setString(&c.Database.Name)},
+		{"REDIS_ADDR", "redis-addr", "Redis address", setString(&c.Redis.Addr)},
+		{"REDIS_PASSWORD", "redis-password", "Redis password", setString(&c.Redis.Password)},
+		{"REDIS_DB", "redis-db", "Redis database number", setInt(&c.Redis.DB)},
+		{"ACCESS_SECRET", "access-secret", "Access token signing secret", setString(&c.JWT.AccessSecret)},
+		{"REFRESH_SECRET", "refresh-secret", "Refresh token signing secret", setString(&c.JWT.RefreshSecret)},
+		{"ACCESS_TTL", "access-ttl", "Access token lifetime", setDuration(&c.JWT.AccessTTL)},
+		{"REFRESH_TTL", "refresh-ttl", "Refresh token lifetime", setDuration(&c.JWT.RefreshTTL)},
+		{"KEY_ROTATION", "key-rotation", "How long a signing key is used before the next one", setDuration(&c.JWT.KeyRotation)},
+		{"KEY_PREPUBLISH", "key-prepublish", "How early the next signing key is published", setDuration(&c.JWT.KeyPrepublish)},
+		{"KEY_ENCRYPTION_KEY", "key-encryption-key", "Base64 key signing keys and authenticator secrets are encrypted with", setString(&c.JWT.KeyEncryptionKey)},
+		{"PASSWORD_COST", "password-cost", "bcrypt cost for local passwords", setInt(&c.Password.Cost)},
+		{"MAIL_DRIVER", "mail-driver", "Mail driver: smtp, outbox or log", setString(&c.Mail.Driver)},
+		{"MAIL_HOST", "mail-host", "SMTP host", setString(&c.Mail.Host)},
+		{"MAIL_PORT", "mail-port", "SMTP port", setInt(&c.Mail.Port)},
+		{"GMAIL_USER", "gmail-user", "SMTP user, named after the original Gmail account", setString(&c.Mail.User)},
+		{"GMAIL_PASSWORD", "gmail-password", "SMTP password", setString(&c.Mail.Password)},
+		{"MAIL_FROM", "mail-from", "Sender address", setString(&c.Mail.From)},
+		{"MAIL_FROM_NAME", "mail-from-name", "Sender display name", setString(&c.Mail.FromName)},
+		{"MAIL_OUTBOX_DIR", "mail-outbox-dir", "Directory the outbox driver writes mail to", setString(&c.Mail.OutboxDir)},
+		{"MAIL_TEMPLATE_DIR", "mail-template-dir", "Directory with mail templates overriding the built in ones", setString(&c.Mail.TemplateDir)},
+		{"MAIL_LOCALE", "mail-locale", "Mail language when the recipient's is not available", setString(&c.Mail.Locale)},
+		{"MAIL_QUEUE_WORKERS", "mail-queue-workers", "Number of mail sending workers", setInt(&c.MailQueue.Workers)},
+		{"MAIL_QUEUE_MAX_ATTEMPTS", "mail-queue-max-attempts", "Sends tried before mail is dead-lettered", setInt(&c.MailQueue.MaxAttempts)},
+		{"MAIL_QUEUE_BACKOFF", "mail-queue-backoff", "Wait before the first retry, doubled on every retry", setDuration(&c.MailQueue.Backoff)},
+		{"MAIL_QUEUE_MAX_BACKOFF", "mail-queue-max-backoff", "Longest wait between retries", setDuration(&c.MailQueue.MaxBackoff)},
+		{"MAIL_QUEUE_RETENTION", "mail-queue-retention", "How long sent and dead mail can be looked up", setDuration(&c.MailQueue.Retention)},
+		{"OTP_CODE_TTL", "otp-code-ttl", "Lifetime of email verification codes", setDuration(&c.OTP.CodeTTL)},
+		{"OTP_TICKET_TTL", "otp-ticket-ttl", "Lifetime of verified email tickets", setDuration(&c.OTP.TicketTTL)},
+		{"OTP_MAX_ATTEMPTS", "otp-max-attempts", "Wrong codes allowed before a code is burned", setInt(&c.OTP.MaxAttempts)},
+		{"NAVER_ID", "naver-id", "Naver OAuth client id", setString(&c.OAuth.Naver.ClientID)},
+		{"NAVER_SECRET", "naver-secret", "Naver OAuth client secret", setString(&c.OAuth.Naver.ClientSecret)},
+		{"NAVER_REDIRECT_URL", "naver-redirect-url", "Naver OAuth callback URL", setString(&c.OAuth.Naver.RedirectURL)},
+		{"KAKAO_ID", "kakao-id", "Kakao OAuth client id", setString(&c.OAuth.Kakao.ClientID)},
+		{"KAKAO_SECRET", "kakao-secret", "Kakao OAuth client secret", setString(&c.OAuth.Kakao.ClientSecret)},
+		{"KAKAO_REDIRECT_URL", "kakao-redirect-url", "Kakao OAuth callback URL", setString(&c.OAuth.Kakao.RedirectURL)},
+		{"GOOGLE_ID", "google-id", "Google OAuth client id", setString(&c.OAuth.Google.ClientID)},
+		{"GOOGLE_SECRET", "google-secret", "Google OAuth client secret", setString(&c.OAuth.Google.ClientSecret)},
+		{"GOOGLE_REDIRECT_URL", "google-redirect-url", "Google OAuth callback URL", setString(&c.OAuth.Google.RedirectURL)},
+		{"APPLE_ID", "apple-id", "Apple services id", setString(&c.OAuth.Apple.ClientID)},
+		{"APPLE_SECRET", "apple-secret", "Apple client secret JWT", setString(&c.OAuth.Apple.ClientSecret)},
+		{"APPLE_REDIRECT_URL", "apple-redirect-url", "Apple OAuth callback URL", setString(&c.OAuth.Apple.RedirectURL)},
+		{"APP_REDIRECT_URIS", "app-redirect-uris", "Comma separated app URIs sign in codes may be sent to", setStrings(&c.App.RedirectURIs)},
+		{"APP_CODE_TTL", "app-code-ttl", "Lifetime of codes the app exchanges for tokens", setDuration(&c.App.CodeTTL)},
+		{"ACCOUNT_DELETION_GRACE", "account-deletion-grace", "How long a deleted account can be restored", setDuration(&c.Account.DeletionGrace)},
+		{"ACCOUNT_PURGE_INTERVAL", "account-purge-interval", "How often deleted accounts are purged", setDuration(&c.Account.PurgeInterval)},
+		{"RATE_LIMIT_ENABLED", "rate-limit-enabled", "Throttle sign in, sign up, mail, code and token routes", setBool(&c.RateLimit.Enabled)},
+		{"RATE_LIMIT_LOGIN_WINDOW", "rate-limit-login-window", "Sign in rate limit window", setDuration(&c.RateLimit.Login.Window)},
+		{"RATE_LIMIT_LOGIN_PER_IP", "rate-limit-login-per-ip", "Sign in requests allowed per IP in the window", setInt(&c.RateLimit.Login.PerIP)},
+		{"RATE_LIMIT_LOGIN_PER_EMAIL", "rate-limit-login-per-email", "Sign in requests allowed per email in the window", setInt(&c.RateLimit.Login.PerEmail)},
+		{"RATE_LIMIT_LOGIN_PER_ACCOUNT", "rate-limit-login-per-account", "Sign in requests allowed per account in the window", setInt(&c.RateLimit.Login.PerAccount)},
+		{"RATE_LIMIT_MAIL_WINDOW", "rate-limit-mail-window", "Mail sending rate limit window", setDuration(&c.RateLimit.Mail.Window)},
+		{"RATE_LIMIT_MAIL_PER_IP", "rate-limit-mail-per-ip", "Mail sending requests allowed per IP in the window", setInt(&c.RateLimit.Mail.PerIP)},
+		{"RATE_LIMIT_MAIL_PER_EMAIL", "rate-limit-mail-per-email", "Mail sending requests allowed per email in the window", setInt(&c.RateLimit.Mail.PerEmail)},
+		{"RATE_LIMIT_MAIL_PER_ACCOUNT", "rate-limit-mail-per-account", "Mail sending requests allowed per account in the window", setInt(&c.RateLimit.Mail.PerAccount)},
+		{"RATE_LIMIT_CODE_WINDOW", "rate-limit-code-window", "Verification code rate limit window", setDuration(&c.RateLimit.Code.Window)},
+		{"RATE_LIMIT_CODE_PER_IP", "rate-limit-code-per-ip", "Verification code requests allowed per IP in the window", setInt(&c.RateLimit.Code.PerIP)},
+		{"RATE_LIMIT_CODE_PER_EMAIL", "rate-limit-code-per-email", "Verification code requests allowed per email in the window", setInt(&c.RateLimit.Code.PerEmail)},
+		{"RATE_LIMIT_CODE_PER_ACCOUNT", "rate-limit-code-per-account", "Verification code requests allowed per account in the window", setInt(&c.RateLimit.Code.PerAccount)},
+		{"RATE_LIMIT_NICKNAME_WINDOW", "rate-limit-nickname-window", "Nickname check rate limit window", setDuration(&c.RateLimit.Nickname.Window)},
+		{"RATE_LIMIT_NICKNAME_PER_IP", "rate-limit-nickname-per-ip", "Nickname check requests allowed per IP in the window", setInt(&c.RateLimit.Nickname.PerIP)},
+		{"RATE_LIMIT_NICKNAME_PER_EMAIL", "rate-limit-nickname-per-email", "Nickname check requests allowed per email in the window", setInt(&c.RateLimit.Nickname.PerEmail)},
+		{"RATE_LIMIT_NICKNAME_PER_ACCOUNT", "rate-limit-nickname-per-account", "Nickname check requests allowed per account in the window", setInt(&c.RateLimit.Nickname.PerAccount)},
+		{"RATE_LIMIT_REGISTER_WINDOW", "rate-limit-register-window", "Sign up rate limit window", setDuration(&c.RateLimit.Register.Window)},
+		{"RATE_LIMIT_REGISTER_PER_IP", "rate-limit-register-per-ip", "Sign up requests allowed per IP in the window", setInt(&c.RateLimit.Register.PerIP)},
+		{"RATE_LIMIT_REGISTER_PER_EMAIL", "rate-limit-register-per-email", "Sign up requests allowed per email in the window", setInt(&c.RateLimit.Register.PerEmail)},
+		{"RATE_LIMIT_REGISTER_PER_ACCOUNT", "rate-limit-register-per-account", "Sign up requests allowed per account in the window", setInt(&c.RateLimit.Register.PerAccount)},
+		{"RATE_LIMIT_EXCHANGE_WINDOW", "rate-limit-exchange-window", "Code exchange rate limit window", setDuration(&c.RateLimit.Exchange.Window)},
+		{"RATE_LIMIT_EXCHANGE_PER_IP", "rate-limit-exchange-per-ip", "Code exchange requests allowed per IP in the window", setInt(&c.RateLimit.Exchange.PerIP)},
+		{"RATE_LIMIT_EXCHANGE_PER_EMAIL", "rate-limit-exchange-per-email", "Code exchange requests allowed per email in the window", setInt(&c.RateLimit.Exchange.PerEmail)},
+		{"RATE_LIMIT_EXCHANGE_PER_ACCOUNT", "rate-limit-exchange-per-account", "Code exchange requests allowed per account in the window", setInt(&c.RateLimit.Exchange.PerAccount)},
+		{"RATE_LIMIT_REFRESH_WINDOW", "rate-limit-refresh-window", "Token refresh rate limit window", setDuration(&c.RateLimit.Refresh.Window)},
+		{"RATE_LIMIT_REFRESH_PER_IP", "rate-limit-refresh-per-ip", "Token refresh requests allowed per IP in the window", setInt(&c.RateLimit.Refresh.PerIP)},
+		{"RATE_LIMIT_REFRESH_PER_EMAIL", "rate-limit-refresh-per-email", "Token refresh requests allowed per email in the window", setInt(&c.RateLimit.Refresh.PerEmail)},
+		{"RATE_LIMIT_REFRESH_PER_ACCOUNT", "rate-limit-refresh-per-account", "Token refresh requests allowed per account in the window", setInt(&c.RateLimit.Refresh.PerAccount)},
+		{"LOCKOUT_WINDOW", "lockout-window", "How long failed sign ins are counted", setDuration(&c.Lockout.Window)},
+		{"LOCKOUT_DELAY_AFTER", "lockout-delay-after", "Failed sign ins before attempts are delayed", setInt(&c.Lockout.DelayAfter)},
+		{"LOCKOUT_DELAY", "lockout-delay", "First delay, doubled on every further failure", setDuration(&c.Lockout.Delay)},
+		{"LOCKOUT_LOCK_AFTER", "lockout-lock-after", "Failed sign ins before the account is locked", setInt(&c.Lockout.LockAfter)},
+		{"LOCKOUT_DURATION", "lockout-duration", "How long accounts and IPs stay locked", setDuration(&c.Lockout.LockDuration)},
+		{"LOCKOUT_IP_LOCK_AFTER", "lockout-ip-lock-after", "Failed sign ins from one IP before it is locked", setInt(&c.Lockout.IPLockAfter)},
+		{"TWO_FACTOR_ISSUER", "two-factor-issuer", "Name authenticator apps show for accounts", setString(&c.TwoFactor.Issuer)},
+		{"TWO_FACTOR_CHALLENGE_TTL", "two-factor-challenge-ttl", "Time to enter the code after the password", setDuration(&c.TwoFactor.ChallengeTTL)},
+		{"TWO_FACTOR_MAX_ATTEMPTS", "two-factor-max-attempts", "Wrong codes allowed per sign in challenge", setInt(&c.TwoFactor.MaxAttempts)},
+		{"TWO_FACTOR_RECOVERY_CODES", "two-factor-recovery-codes", "Number of recovery codes issued", setInt(&c.TwoFactor.RecoveryCodes)},
+	}
+}
+
+func setBool(target *bool) func(string) error {
+	return func(val string) error {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		*target = b
+		return nil
+	}
+}
+
+func setString(target *string) func(string) error {
+	return func(val string) error {
+		*target = val
+		return nil
+	}
+}
+
+func setStrings(target *[]string) func(string) error {
+	return func(val string) error {
+		values := []string{}
+		for _, v := range strings.Split(val, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*target = values
+		return nil
+	}
+}
+
+func setDuration(target *time.Duration) func(string) error {
+	return func(val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*target = d
+		return nil
+	}
+}
+
+func setInt(target *int) func(string) error {
+	return func(val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		*target = n
+		return nil
+	}
+}
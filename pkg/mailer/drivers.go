@@ -0,0 +1,95 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pdserver/pkg/config"
+	"strings"
+	"time"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+// SMTPDriver - Sends through an SMTP server with STARTTLS
+type SMTPDriver struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	From     string
+	FromName string
+}
+
+func NewSMTPDriver(cfg config.MailConfig) *SMTPDriver {
+	return &SMTPDriver{Host: cfg.Host, Port: cfg.Port, User: cfg.User, Password: cfg.Password,
+		From: cfg.From, FromName: cfg.FromName}
+}
+
+func (d *SMTPDriver) Deliver(msg *Message) error {
+	dial := gomail.NewDialer(d.Host, d.Port, d.User, d.Password)
+	return dial.DialAndSend(compose(msg, d.From, d.FromName))
+}
+
+// OutboxDriver - Writes every message to an .eml file in Dir instead of sending it,
+// for local development and tests
+type OutboxDriver struct {
+	Dir      string
+	From     string
+	FromName string
+}
+
+func NewOutboxDriver(cfg config.MailConfig) (*OutboxDriver, error) {
+	if err := os.MkdirAll(cfg.OutboxDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &OutboxDriver{Dir: cfg.OutboxDir, From: cfg.From, FromName: cfg.FromName}, nil
+}
+
+func (d *OutboxDriver) Deliver(msg *Message) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	// Sorting the file names orders the outbox by time
+	name := fmt.Sprintf("%s-%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"),
+		strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To), hex.EncodeToString(suffix))
+	file, err := os.OpenFile(filepath.Join(d.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := compose(msg, d.From, d.FromName).WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LogDriver - Prints the text part to the standard logger
+type LogDriver struct{}
+
+func NewLogDriver() *LogDriver {
+	return &LogDriver{}
+}
+
+func (d *LogDriver) Deliver(msg *Message) error {
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+func compose(msg *Message, from string, fromName string) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeaders(map[string][]string{
+		"From":    {m.FormatAddress(from, fromName)},
+		"To":      {msg.To},
+		"Subject": {msg.Subject},
+	})
+	m.SetBody("text/plain", msg.Text)
+	if msg.HTML != "" {
+		m.AddAlternative("text/html", msg.HTML)
+	}
+	return m
+}
@@ -0,0 +1,78 @@
+package mailer
+
+import (
+	"fmt"
+	"pdserver/pkg/config"
+)
+
+// Templates shipped in templates/<locale>/<name>.txt and <name>.html
+const (
+	TemplateSignupCode    = "signup_code"
+	TemplatePasswordReset = "password_reset"
+	TemplateNewDevice     = "new_device"
+	TemplateAccountLocked = "account_locked"
+	TemplateAccountUnlock = "account_unlock"
+	TemplateEmailChanged  = "email_changed"
+)
+
+// Message - Rendered mail, HTML is sent as an alternative to Text
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Driver - Delivers rendered messages
+type Driver interface {
+	Deliver(msg *Message) error
+}
+
+// Mailer - Renders templates and hands the result to the configured driver
+type Mailer struct {
+	Driver    Driver
+	Templates *Templates
+	Locale    string
+}
+
+// New - Mailer with the driver and templates of the configuration
+func New(cfg config.MailConfig) (*Mailer, error) {
+	driver, err := NewDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := LoadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	if !templates.Has(TemplateSignupCode, cfg.Locale) {
+		return nil, fmt.Errorf("No mail templates for locale %s", cfg.Locale)
+	}
+	return &Mailer{Driver: driver, Templates: templates, Locale: cfg.Locale}, nil
+}
+
+// NewDriver - smtp, outbox or log driver
+func NewDriver(cfg config.MailConfig) (Driver, error) {
+	switch cfg.Driver {
+	case config.MailDriverSMTP:
+		return NewSMTPDriver(cfg), nil
+	case config.MailDriverOutbox:
+		return NewOutboxDriver(cfg)
+	case config.MailDriverLog:
+		return NewLogDriver(), nil
+	}
+	return nil, fmt.Errorf("Unknown mail driver %s", cfg.Driver)
+}
+
+// Send - Render template in locale, the configured locale is used when it has no such template
+func (m *Mailer) Send(to string, template string, locale string, data map[string]string) error {
+	if locale == "" || !m.Templates.Has(template, locale) {
+		locale = m.Locale
+	}
+	msg, err := m.Templates.Render(template, locale, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+	return m.Driver.Deliver(msg)
+}
@@ -0,0 +1,117 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var builtinTemplates embed.FS
+
+// Templates - Parsed mail templates by locale and name.
+// The .txt file defines the "subject" and "text" blocks, the .html file is the HTML body.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// LoadTemplates - Built in templates, files under dir replace the built in file of the same path
+func LoadTemplates(dir string) (*Templates, error) {
+	builtin, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	var override fs.FS
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		override = os.DirFS(dir)
+	}
+	t := &Templates{text: map[string]*texttemplate.Template{}, html: map[string]*htmltemplate.Template{}}
+	err = fs.WalkDir(builtin, ".", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := readTemplate(file, override, builtin)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(file, path.Ext(file))
+		switch path.Ext(file) {
+		case ".txt":
+			parsed, err := texttemplate.New(file).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return err
+			}
+			for _, block := range []string{"subject", "text"} {
+				if parsed.Lookup(block) == nil {
+					return fmt.Errorf("Mail template %s has no %s block", file, block)
+				}
+			}
+			t.text[key] = parsed
+		case ".html":
+			parsed, err := htmltemplate.New(file).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return err
+			}
+			t.html[key] = parsed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func readTemplate(file string, override fs.FS, builtin fs.FS) ([]byte, error) {
+	if override != nil {
+		data, err := fs.ReadFile(override, file)
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return fs.ReadFile(builtin, file)
+}
+
+// Has - Whether name exists in locale
+func (t *Templates) Has(name string, locale string) bool {
+	_, ok := t.text[locale+"/"+name]
+	return ok
+}
+
+// Render - Message without recipient, HTML is left empty when the locale has no .html file
+func (t *Templates) Render(name string, locale string, data map[string]string) (*Message, error) {
+	key := locale + "/" + name
+	text, ok := t.text[key]
+	if !ok {
+		return nil, fmt.Errorf("Unknown mail template %s", key)
+	}
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "text", data); err != nil {
+		return nil, err
+	}
+	msg := &Message{Subject: strings.TrimSpace(subject.String()), Text: strings.TrimSpace(body.String()) + "\n"}
+	if html, ok := t.html[key]; ok {
+		var buf bytes.Buffer
+		if err := html.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
@@ -3,22 +3,18 @@ package repository
 import (
 	"fmt"
 	"log"
-	"os"
+	"pdserver/pkg/config"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 )
 
-func NewDatabase() (*gorm.DB, error) {
-	dbUserName := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbHost := os.Getenv("DB_HOST")
-	dbName := os.Getenv("DB_NAME")
-	dbPort := os.Getenv("DB_PORT")
-
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
-		dbUserName, dbPassword, dbHost, dbPort, dbName)
+// NewDatabase - Connect to MySQL. parseTime scans DATETIME columns into time.Time,
+// loc=UTC matches the UTC times the server writes.
+func NewDatabase(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=UTC&charset=utf8mb4",
+		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)
 	db, err := gorm.Open("mysql", connectionString)
 	if err != nil {
 		log.Println(err.Error())
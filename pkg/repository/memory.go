@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value  string
+	set    map[string]struct{}
+	zset   map[string]float64
+	expire time.Time
+}
+
+// MemoryStore - In-memory key value store, used in place of redis for tests
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string]memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string]memoryEntry{}}
+}
+
+func (s *MemoryStore) Set(key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expire = time.Now().Add(ttl)
+	}
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return "", ErrNil
+	}
+	if entry.set != nil || entry.zset != nil {
+		return "", errWrongType(key)
+	}
+	return entry.value, nil
+}
+
+func (s *MemoryStore) Del(keys ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := s.lookup(key); ok {
+			delete(s.data, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) Incr(key string) (int64, error) {
+	return s.add(key, 1)
+}
+
+func (s *MemoryStore) Decr(key string) (int64, error) {
+	return s.add(key, -1)
+}
+
+func (s *MemoryStore) add(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, _ := s.lookup(key)
+	if entry.set != nil || entry.zset != nil {
+		return 0, errWrongType(key)
+	}
+	n := int64(0)
+	if entry.value != "" {
+		parsed, err := strconv.ParseInt(entry.value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		n = parsed
+	}
+	n += delta
+	entry.value = strconv.FormatInt(n, 10)
+	s.data[key] = entry
+	return n, nil
+}
+
+func (s *MemoryStore) Expire(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil
+	}
+	entry.expire = time.Now().Add(ttl)
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) SAdd(key string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if ok && entry.set == nil {
+		return errWrongType(key)
+	}
+	if !ok {
+		entry = memoryEntry{set: map[string]struct{}{}}
+	}
+	for _, member := range members {
+		entry.set[member] = struct{}{}
+	}
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) SRem(key string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil
+	}
+	if entry.set == nil {
+		return errWrongType(key)
+	}
+	for _, member := range members {
+		delete(entry.set, member)
+	}
+	if len(entry.set) == 0 {
+		delete(s.data, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SMembers(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return []string{}, nil
+	}
+	if entry.set == nil {
+		return nil, errWrongType(key)
+	}
+	members := make([]string, 0, len(entry.set))
+	for member := range entry.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *MemoryStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expire = time.Now().Add(ttl)
+	}
+	s.data[key] = entry
+	return true, nil
+}
+
+func (s *MemoryStore) DelIfEqual(key string, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok || entry.set != nil || entry.zset != nil || entry.value != value {
+		return false, nil
+	}
+	delete(s.data, key)
+	return true, nil
+}
+
+func (s *MemoryStore) ZAdd(key string, score float64, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if ok && entry.zset == nil {
+		return errWrongType(key)
+	}
+	if !ok {
+		entry = memoryEntry{zset: map[string]float64{}}
+	}
+	entry.zset[member] = score
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) ZRem(key string, members ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	if entry.zset == nil {
+		return 0, errWrongType(key)
+	}
+	var removed int64
+	for _, member := range members {
+		if _, ok := entry.zset[member]; ok {
+			delete(entry.zset, member)
+			removed++
+		}
+	}
+	if len(entry.zset) == 0 {
+		delete(s.data, key)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStore) ZRangeByScore(key string, max float64, limit int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return []string{}, nil
+	}
+	if entry.zset == nil {
+		return nil, errWrongType(key)
+	}
+	members := []string{}
+	for member, score := range entry.zset {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := entry.zset[members[i]], entry.zset[members[j]]
+		if a == b {
+			return members[i] < members[j]
+		}
+		return a < b
+	})
+	if limit > 0 && int64(len(members)) > limit {
+		members = members[:limit]
+	}
+	return members, nil
+}
+
+// lookup - Get entry, dropping it when expired. Caller must hold mu
+func (s *MemoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := s.data[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		delete(s.data, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+func errWrongType(key string) error {
+	return fmt.Errorf("Wrong type of value held by %s", key)
+}
@@ -0,0 +1,27 @@
+package repository
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Fatalf("migration %d is at position %d", migration.Version, i+1)
+		}
+	}
+	latest := migrations[len(migrations)-1]
+	if latest.Name != "totp_sealed_secret" {
+		t.Fatalf("latest migration %s", latest.Name)
+	}
+	// Comments of the unique index migration hold example queries that must not run
+	unique := migrations[6]
+	if statements := splitStatements(unique.Up); len(statements) != 1 {
+		t.Fatalf("%d statements in %s: %q", len(statements), unique.Name, statements)
+	}
+	if statements := splitStatements(latest.Up); len(statements) != 3 {
+		t.Fatalf("%d statements in %s: %q", len(statements), latest.Name, statements)
+	}
+}
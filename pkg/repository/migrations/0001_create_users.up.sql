@@ -0,0 +1,10 @@
+-- Adopts databases created from the old initdb scripts, hence IF NOT EXISTS
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    nickname VARCHAR(255) NOT NULL DEFAULT '',
+    birth VARCHAR(32) NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD INDEX idx_users_deleted_at (deleted_at);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    DROP COLUMN avatar,
+    DROP COLUMN created_at;
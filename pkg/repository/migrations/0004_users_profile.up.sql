@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN avatar VARCHAR(1024) NOT NULL DEFAULT '',
+    ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP;
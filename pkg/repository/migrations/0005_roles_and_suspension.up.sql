@@ -0,0 +1,7 @@
+CREATE TABLE user_roles (
+    user_id BIGINT UNSIGNED NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    PRIMARY KEY (user_id, role)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE users ADD COLUMN suspended_at DATETIME NULL;
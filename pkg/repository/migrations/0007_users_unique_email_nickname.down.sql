@@ -0,0 +1,5 @@
+ALTER TABLE users
+    DROP INDEX idx_users_email,
+    DROP INDEX idx_users_nickname,
+    DROP COLUMN email_key,
+    DROP COLUMN nickname_key;
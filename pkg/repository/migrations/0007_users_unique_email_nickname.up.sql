@@ -0,0 +1,13 @@
+-- Availability checks alone let two concurrent sign ups take the same email or nickname.
+-- Provider accounts may come without either, so the indexes are on generated columns that are
+-- NULL for empty values and MySQL allows any number of NULLs in a unique index.
+-- Soft deleted users keep their rows, so their email and nickname stay taken until
+-- AccountPurger hard deletes them, the same as Available already reports.
+-- Existing duplicates make this migration fail, find them first with
+--   SELECT email, COUNT(*) FROM users WHERE email <> '' GROUP BY email HAVING COUNT(*) > 1;
+--   SELECT nickname, COUNT(*) FROM users WHERE nickname <> '' GROUP BY nickname HAVING COUNT(*) > 1;
+ALTER TABLE users
+    ADD COLUMN email_key VARCHAR(255) AS (NULLIF(email, '')) STORED,
+    ADD COLUMN nickname_key VARCHAR(255) AS (NULLIF(nickname, '')) STORED,
+    ADD UNIQUE INDEX idx_users_email (email_key),
+    ADD UNIQUE INDEX idx_users_nickname (nickname_key);
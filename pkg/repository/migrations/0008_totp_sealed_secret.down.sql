@@ -0,0 +1,3 @@
+DELETE FROM recovery_codes;
+DELETE FROM totp_credentials;
+ALTER TABLE totp_credentials MODIFY secret VARCHAR(64) NOT NULL;
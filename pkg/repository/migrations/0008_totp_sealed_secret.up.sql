@@ -0,0 +1,6 @@
+-- Authenticator secrets are stored encrypted with the key encryption key, base64 of nonce and ciphertext.
+-- Secrets saved before were plaintext and cannot be encrypted here, so those enrollments are dropped
+-- with their recovery codes and the users set up two-factor sign in again.
+DELETE FROM recovery_codes;
+DELETE FROM totp_credentials;
+ALTER TABLE totp_credentials MODIFY secret VARCHAR(255) NOT NULL;
@@ -1,13 +1,31 @@
 package repository
 
-import "github.com/go-redis/redis"
+import (
+	"errors"
+	"pdserver/pkg/config"
+	"strconv"
+	"time"
 
-func NewClient() (*redis.Client, error) {
-	var client *redis.Client
+	"github.com/go-redis/redis"
+)
 
-	client = redis.NewClient(&redis.Options{
-		// Addr: "redis:6379", //for docker
-		Addr: "localhost:6379",
+// delIfEqualScript - Compare and delete in one step, no other client can take the key in between
+var delIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type RedisStore struct {
+	Client *redis.Client
+}
+
+func NewClient(cfg config.RedisConfig) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 	_, err := client.Ping().Result()
 	if err != nil {
@@ -22,3 +40,81 @@ func CloseRedisDB(client *redis.Client) error {
 	}
 	return nil
 }
+
+// NewRedisStore - Wrap redis client as key value store
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{Client: client}
+}
+
+func (s *RedisStore) Set(key string, value string, ttl time.Duration) error {
+	return s.Client.Set(key, value, ttl).Err()
+}
+
+func (s *RedisStore) Get(key string) (string, error) {
+	val, err := s.Client.Get(key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNil
+	}
+	return val, err
+}
+
+func (s *RedisStore) Del(keys ...string) (int64, error) {
+	return s.Client.Del(keys...).Result()
+}
+
+func (s *RedisStore) Incr(key string) (int64, error) {
+	return s.Client.Incr(key).Result()
+}
+
+func (s *RedisStore) Decr(key string) (int64, error) {
+	return s.Client.Decr(key).Result()
+}
+
+func (s *RedisStore) Expire(key string, ttl time.Duration) error {
+	return s.Client.Expire(key, ttl).Err()
+}
+
+func (s *RedisStore) SAdd(key string, members ...string) error {
+	return s.Client.SAdd(key, toInterfaces(members)...).Err()
+}
+
+func (s *RedisStore) SRem(key string, members ...string) error {
+	return s.Client.SRem(key, toInterfaces(members)...).Err()
+}
+
+func (s *RedisStore) SMembers(key string) ([]string, error) {
+	return s.Client.SMembers(key).Result()
+}
+
+func (s *RedisStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return s.Client.SetNX(key, value, ttl).Result()
+}
+
+func (s *RedisStore) DelIfEqual(key string, value string) (bool, error) {
+	n, err := delIfEqualScript.Run(s.Client, []string{key}, value).Int64()
+	return n > 0, err
+}
+
+func (s *RedisStore) ZAdd(key string, score float64, member string) error {
+	return s.Client.ZAdd(key, redis.Z{Score: score, Member: member}).Err()
+}
+
+func (s *RedisStore) ZRem(key string, members ...string) (int64, error) {
+	return s.Client.ZRem(key, toInterfaces(members)...).Result()
+}
+
+func (s *RedisStore) ZRangeByScore(key string, max float64, limit int64) ([]string, error) {
+	return s.Client.ZRangeByScore(key, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(max, 'f', -1, 64),
+		Count: limit,
+	}).Result()
+}
+
+func toInterfaces(vals []string) []interface{} {
+	res := make([]interface{}, len(vals))
+	for i, val := range vals {
+		res[i] = val
+	}
+	return res
+}
@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNil - Returned by Get when the key does not exist
+var ErrNil = errors.New("Key does not exist")
+
+// KeyValueStore - Storage used for tokens and other short lived data
+type KeyValueStore interface {
+	Set(key string, value string, ttl time.Duration) error
+	Get(key string) (string, error)
+	Del(keys ...string) (int64, error)
+	Incr(key string) (int64, error)
+	Decr(key string) (int64, error)
+	Expire(key string, ttl time.Duration) error
+	SAdd(key string, members ...string) error
+	SRem(key string, members ...string) error
+	SMembers(key string) ([]string, error)
+	// SetNX - Set only when key does not exist, false when it already did
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	// DelIfEqual - Delete key only while it still holds value, releases a lock taken with SetNX by its owner
+	DelIfEqual(key string, value string) (bool, error)
+	ZAdd(key string, score float64, member string) error
+	// ZRem - Number of members removed, used to claim a member between competing workers
+	ZRem(key string, members ...string) (int64, error)
+	// ZRangeByScore - Up to limit members with score at most max, lowest score first
+	ZRangeByScore(key string, max float64, limit int64) ([]string, error)
+}